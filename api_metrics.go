@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// apiMetrics counts the requests made to the Google APIs. The Admin SDK does
+// not report remaining quota in its responses, so rate limiting shows up as
+// errors with code 429 or 403. Quota scrapes served from the cached usage
+// report instead of the API are counted as cache hits.
+type apiMetrics struct {
+	requests      *prometheus.CounterVec
+	errors        *prometheus.CounterVec
+	lookbackSteps *prometheus.HistogramVec
+	cacheHits     *prometheus.CounterVec
+	cacheMisses   *prometheus.CounterVec
+}
+
+func newAPIMetrics(namespace string) *apiMetrics {
+	return &apiMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "api_requests_total",
+			Help:        "Number of requests made to the Google APIs",
+			ConstLabels: conf.ConstLabels,
+		}, customerLabels),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "api_errors_total",
+			Help: "Number of failed requests to the Google APIs by HTTP " +
+				"status code, where code=\"\" is a request which got no " +
+				"response",
+			ConstLabels: conf.ConstLabels,
+		}, []string{"customer_id", "code"}),
+		lookbackSteps: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "report_lookback_steps",
+			Help: "Number of report dates tried before finding a customer " +
+				"usage report with data",
+			Buckets:     prometheus.LinearBuckets(1, 1, conf.LookbackDays+1),
+			ConstLabels: conf.ConstLabels,
+		}, customerLabels),
+		cacheHits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cache_hits_total",
+			Help: "Number of quota scrapes which served the customer " +
+				"usage report from the cache",
+			ConstLabels: conf.ConstLabels,
+		}, customerLabels),
+		cacheMisses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cache_misses_total",
+			Help: "Number of quota scrapes which could not serve the " +
+				"customer usage report from the cache, because it was " +
+				"empty or older than CACHE_TTL",
+			ConstLabels: conf.ConstLabels,
+		}, customerLabels),
+	}
+}
+
+func (m *apiMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.requests.Describe(ch)
+	m.errors.Describe(ch)
+	m.lookbackSteps.Describe(ch)
+	m.cacheHits.Describe(ch)
+	m.cacheMisses.Describe(ch)
+}
+
+func (m *apiMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.requests.Collect(ch)
+	m.errors.Collect(ch)
+	m.lookbackSteps.Collect(ch)
+	m.cacheHits.Collect(ch)
+	m.cacheMisses.Collect(ch)
+}
+
+// transport returns a http.RoundTripper which counts the requests made
+// through next on behalf of the given customer.
+func (m *apiMetrics) transport(
+	customerID string, next http.RoundTripper,
+) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	labels := prometheus.Labels{"customer_id": customerID}
+
+	return &apiMetricsTransport{
+		requests: m.requests.With(labels),
+		errors:   m.errors.MustCurryWith(labels),
+		next:     next,
+	}
+}
+
+type apiMetricsTransport struct {
+	requests prometheus.Counter
+	errors   *prometheus.CounterVec
+	next     http.RoundTripper
+}
+
+func (t *apiMetricsTransport) RoundTrip(
+	req *http.Request,
+) (*http.Response, error) {
+	t.requests.Inc()
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		t.errors.WithLabelValues("").Inc()
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		t.errors.WithLabelValues(strconv.Itoa(resp.StatusCode)).Inc()
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// usageAppRE matches the application prefixes of usage report parameters,
+// such as classroom.
+var usageAppRE = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// AppUsageCollector exposes every numeric parameter of the customer usage
+// report which belongs to one of the configured applications, such as all
+// classroom:* parameters. The parameters are only known once a report has
+// been fetched, so the collector is unchecked and describes no metrics.
+type AppUsageCollector struct {
+	namespace string
+	apps      map[string]bool
+	// exposed holds the parameters already exposed by the QuotaCollector.
+	exposed   map[string]bool
+	customers []*customer
+}
+
+func NewAppUsageCollector(
+	namespace string, apps []string, customers []*customer,
+	usage []usageMetric,
+) *AppUsageCollector {
+	c := &AppUsageCollector{
+		namespace: namespace,
+		apps:      make(map[string]bool, len(apps)),
+		exposed:   make(map[string]bool, len(usage)),
+		customers: customers,
+	}
+	for _, app := range apps {
+		c.apps[app] = true
+	}
+	for _, m := range usage {
+		c.exposed[m.param] = true
+	}
+
+	return c
+}
+
+func (c *AppUsageCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (c *AppUsageCollector) Collect(ch chan<- prometheus.Metric) {
+	c.CollectWithContext(context.Background(), ch)
+}
+
+func (c *AppUsageCollector) CollectWithContext(
+	ctx context.Context, ch chan<- prometheus.Metric,
+) {
+	collectCustomers(ctx, c.customers, func(
+		ctx context.Context, cust *customer,
+	) {
+		// Failures are logged by the QuotaCollector, which fetches the same
+		// cached report.
+		report, err := cust.cachedUsageReport(ctx)
+		if err != nil {
+			report = cust.lastUsageReport()
+			if report == nil {
+				return
+			}
+		}
+
+		for param, v := range report.params {
+			app, _, _ := strings.Cut(param, ":")
+			if !c.apps[app] || c.exposed[param] ||
+				!usageParameterRE.MatchString(param) {
+				continue
+			}
+
+			desc := prometheus.NewDesc(
+				c.namespace+"_"+strings.ReplaceAll(param, ":", "_"),
+				"Value of the "+param+" usage report parameter on the "+
+					"report date",
+				customerLabels, conf.ConstLabels,
+			)
+			ch <- prometheus.MustNewConstMetric(
+				desc, prometheus.GaugeValue, v, cust.id,
+			)
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/sethvargo/go-envconfig"
+	"gopkg.in/yaml.v3"
+)
+
+// loadConfigFile returns a lookuper for the settings in a YAML or JSON file,
+// which maps environment variable names to their values, such as:
+//
+//	LOOKBACK_DAYS: 7
+//	OAUTH_SCOPES:
+//	  - https://www.googleapis.com/auth/admin.reports.usage.readonly
+//
+// List values are joined with commas, as in the environment, as are the
+// name=value pairs of a CONST_LABELS mapping.
+func loadConfigFile(file string) (envconfig.Lookuper, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read config file: %w", err)
+	}
+
+	var settings map[string]any
+	err = yaml.Unmarshal(b, &settings)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse config file: %w", err)
+	}
+
+	known := configEnvNames()
+	values := make(map[string]string, len(settings))
+	for name, v := range settings {
+		if !known[name] {
+			return nil, fmt.Errorf("Config file has unknown setting %s", name)
+		}
+
+		switch v := v.(type) {
+		case nil:
+			values[name] = ""
+		case []any:
+			items := make([]string, 0, len(v))
+			for _, item := range v {
+				items = append(items, fmt.Sprint(item))
+			}
+			values[name] = strings.Join(items, ",")
+		case map[string]any:
+			// Mappings are only accepted for CONST_LABELS, the one setting
+			// with name=value pairs.
+			if name != "CONST_LABELS" {
+				return nil, fmt.Errorf(
+					"Config file setting %s must not be a mapping", name,
+				)
+			}
+			pairs := make([]string, 0, len(v))
+			for key, value := range v {
+				pairs = append(pairs, key+"="+fmt.Sprint(value))
+			}
+			slices.Sort(pairs)
+			values[name] = strings.Join(pairs, ",")
+		default:
+			values[name] = fmt.Sprint(v)
+		}
+	}
+
+	return envconfig.MapLookuper(values), nil
+}
+
+// configEnvNames returns the environment variable names of the config fields.
+func configEnvNames() map[string]bool {
+	t := reflect.TypeFor[config]()
+
+	names := make(map[string]bool, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("env"), ",")
+		if name != "" {
+			names[name] = true
+		}
+	}
+
+	return names
+}
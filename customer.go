@@ -0,0 +1,660 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
+	admin "google.golang.org/api/admin/reports/v1"
+	"google.golang.org/api/option"
+)
+
+// customerConfig describes how to authenticate against a single Workspace
+// customer. Inline JSON takes precedence over the corresponding file path.
+type customerConfig struct {
+	ID                 string `json:"id"`
+	CredentialsJSON    string `json:"credentials_json"`
+	CredentialsFile    string `json:"credentials_file"`
+	TokenJSON          string `json:"token_json"`
+	TokenFile          string `json:"token_file"`
+	SecondaryTokenFile string `json:"secondary_token_file"`
+	ImpersonateSubject string `json:"impersonate_subject"`
+	UseADC             bool   `json:"use_adc"`
+	// CustomerID is the Google customer ID to report on, defaulting to the
+	// customer of the authenticated user.
+	CustomerID string `json:"customer_id"`
+}
+
+// loadCustomerConfigs returns the customers listed in CUSTOMERS_FILE, or a
+// single unnamed customer built from the environment when it is not set.
+func loadCustomerConfigs() ([]customerConfig, error) {
+	if conf.CustomersFile == "" {
+		return []customerConfig{{
+			CredentialsJSON:    conf.CredentialsJSON,
+			CredentialsFile:    conf.CredentialsFile,
+			TokenJSON:          conf.TokenJSON,
+			TokenFile:          conf.TokenFile,
+			SecondaryTokenFile: conf.SecondaryTokenFile,
+			ImpersonateSubject: conf.ImpersonateSubject,
+			UseADC:             conf.UseADC,
+			CustomerID:         conf.CustomerID,
+		}}, nil
+	}
+
+	b, err := os.ReadFile(conf.CustomersFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read customers file: %w", err)
+	}
+
+	var configs []customerConfig
+	err = json.Unmarshal(b, &configs)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse customers file: %w", err)
+	}
+
+	if len(configs) == 0 {
+		return nil, errors.New("Customers file does not list any customers")
+	}
+
+	seen := make(map[string]bool, len(configs))
+	for _, cc := range configs {
+		if cc.ID == "" {
+			return nil, errors.New("Customers file entry is missing an id")
+		}
+		if seen[cc.ID] {
+			return nil, fmt.Errorf(
+				"Customers file lists customer %s more than once", cc.ID,
+			)
+		}
+		seen[cc.ID] = true
+
+		if cc.CustomerID != "" && !customerIDRE.MatchString(cc.CustomerID) {
+			return nil, fmt.Errorf(
+				"Customers file entry %s has invalid customer_id %q",
+				cc.ID, cc.CustomerID,
+			)
+		}
+	}
+
+	return configs, nil
+}
+
+// UsageReportsGetter fetches the customer usage reports for a date in
+// YYYY-MM-DD format.
+type UsageReportsGetter interface {
+	Get(ctx context.Context, date string) (*admin.UsageReports, error)
+}
+
+// customerUsageReports implements UsageReportsGetter using the admin API.
+type customerUsageReports struct {
+	service    *admin.CustomerUsageReportsService
+	customerID string
+	// parameters is the comma separated list of parameters to request, all
+	// of them when empty.
+	parameters string
+}
+
+func (r customerUsageReports) Get(
+	ctx context.Context, date string,
+) (*admin.UsageReports, error) {
+	call := r.service.Get(date)
+	if r.customerID != "" {
+		call = call.CustomerId(r.customerID)
+	}
+	if r.parameters != "" {
+		call = call.Parameters(r.parameters)
+	}
+
+	return call.Context(ctx).Do()
+}
+
+// customer is a Workspace customer whose usage reports are collected.
+type customer struct {
+	id string
+	// customerID is the Google customer ID passed to the API, empty for the
+	// customer of the authenticated user.
+	customerID string
+	client     *admin.Service
+	reports    UsageReportsGetter
+	// lookbackSteps observes the number of report dates tried by each usage
+	// report fetch.
+	lookbackSteps prometheus.Observer
+	// cacheHits and cacheMisses count whether the usage report of a quota
+	// scrape was served from the cache.
+	cacheHits   prometheus.Counter
+	cacheMisses prometheus.Counter
+	// authInvalid is set once an API call fails because the OAuth token was
+	// revoked or expired, and cleared by the next successful call.
+	authInvalid atomic.Bool
+
+	// fetches collapses concurrent usage report fetches into one.
+	fetches singleflight.Group
+
+	mu     sync.Mutex
+	cached *usageReport
+	// lastErr is the error of the last failed usage report fetch, cleared
+	// by the next successful one.
+	lastErr error
+
+	// historyMu guards history separately from mu, as filling it calls the
+	// API, which must not block the cached report from being read.
+	historyMu sync.Mutex
+	// history caches the used quota in MB of past report dates, keyed by
+	// date. Dates without a report are cached as NaN.
+	history map[string]float64
+}
+
+func newCustomer(
+	ctx context.Context, cc customerConfig, metrics *apiMetrics,
+) (*customer, error) {
+	if conf.Offline {
+		return &customer{
+			id:            cc.ID,
+			reports:       offlineUsageReports{},
+			lookbackSteps: metrics.lookbackSteps.WithLabelValues(cc.ID),
+			cacheHits:     metrics.cacheHits.WithLabelValues(cc.ID),
+			cacheMisses:   metrics.cacheMisses.WithLabelValues(cc.ID),
+		}, nil
+	}
+
+	client, err := newCustomerHTTPClient(ctx, cc)
+	if err != nil {
+		return nil, err
+	}
+	client.Transport = metrics.transport(cc.ID, client.Transport)
+	if conf.OTelEnabled {
+		client.Transport = otelhttp.NewTransport(client.Transport)
+	}
+
+	srv, err := admin.NewService(ctx, option.WithHTTPClient(client))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve reports Client %w", err)
+	}
+	// option.WithUserAgent is ignored along with option.WithHTTPClient, so
+	// the user agent is set on the service instead.
+	srv.UserAgent = conf.userAgent()
+
+	return &customer{
+		id:            cc.ID,
+		customerID:    cc.CustomerID,
+		client:        srv,
+		lookbackSteps: metrics.lookbackSteps.WithLabelValues(cc.ID),
+		cacheHits:     metrics.cacheHits.WithLabelValues(cc.ID),
+		cacheMisses:   metrics.cacheMisses.WithLabelValues(cc.ID),
+		reports: customerUsageReports{
+			service:    srv.CustomerUsageReports,
+			customerID: cc.CustomerID,
+			parameters: requestedUsageParameters(),
+		},
+	}, nil
+}
+
+// QuotaResult holds the quota stats of a customer usage report.
+type QuotaResult struct {
+	// Date is the date of the usage report.
+	Date time.Time
+	// TotalQuota and UsedQuota are in MB.
+	TotalQuota float64
+	UsedQuota  float64
+	// PercentageUsed is the percentage of the total quota used, from 0 to
+	// 100.
+	PercentageUsed float64
+}
+
+// fetchQuotaStats returns the quota stats of the cached usage report, or of
+// the report of date when it is not zero. Reports of an explicit date are
+// fetched bypassing the cache, and there is no lookback to earlier dates when
+// that date has no report.
+func (c *customer) fetchQuotaStats(
+	ctx context.Context, date time.Time,
+) (_ QuotaResult, err error) {
+	ctx, span := tracer.Start(ctx, "fetchQuotaStats", trace.WithAttributes(
+		attribute.String("customer_id", c.id),
+	))
+	defer func() { endSpan(span, err) }()
+
+	var report *usageReport
+	if date.IsZero() {
+		report, err = c.cachedUsageReport(ctx)
+	} else {
+		report, err = c.fetchUsageReportOn(ctx, date)
+	}
+	if err != nil {
+		return QuotaResult{}, err
+	}
+	span.SetAttributes(
+		attribute.String("report.date", report.date.Format("2006-01-02")),
+	)
+
+	return report.quotaResult()
+}
+
+// lastUsageReport returns the most recently fetched usage report regardless of
+// its age, or nil if none has been fetched yet.
+func (c *customer) lastUsageReport() *usageReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.cached
+}
+
+// cachedUsageReport returns the cached customer usage report, fetching a new
+// one when the cache is older than CACHE_TTL. With REFRESH_INTERVAL set it
+// never fetches, and returns the error of the last background refresh if it
+// failed.
+func (c *customer) cachedUsageReport(
+	ctx context.Context,
+) (*usageReport, error) {
+	report, _, err := c.lookupUsageReport(ctx)
+
+	return report, err
+}
+
+// lookupUsageReport is cachedUsageReport, which also reports whether the
+// result was served from the cache. The error of a failed background refresh
+// is served from the cache too, as no fetch is made for it.
+func (c *customer) lookupUsageReport(
+	ctx context.Context,
+) (*usageReport, bool, error) {
+	c.mu.Lock()
+	cached := c.cached
+	lastErr := c.lastErr
+	c.mu.Unlock()
+
+	if conf.RefreshInterval > 0 {
+		if lastErr != nil {
+			return nil, true, lastErr
+		}
+		if cached == nil {
+			return nil, false, errNotRefreshed
+		}
+
+		return cached, true, nil
+	}
+
+	if cached != nil && time.Since(cached.fetchedAt) < conf.CacheTTL {
+		return cached, true, nil
+	}
+
+	report, err := c.fetchUsageReport(ctx)
+
+	return report, false, err
+}
+
+// refreshUsageReport fetches a new customer usage report regardless of the
+// age of the cached one. The cached report is only replaced when the fetch
+// succeeds, so it remains available as the last known report.
+func (c *customer) refreshUsageReport(
+	ctx context.Context,
+) (*usageReport, error) {
+	return c.fetchUsageReport(ctx)
+}
+
+// fetchUsageReport fetches and caches a new customer usage report. Concurrent
+// callers share a single fetch and its result rather than each calling the
+// API. The shared fetch is not cancelled along with the caller which started
+// it, but each caller stops waiting once its own context is done.
+func (c *customer) fetchUsageReport(
+	ctx context.Context,
+) (*usageReport, error) {
+	ch := c.fetches.DoChan("usage", func() (any, error) {
+		t, params, err := c.fetchUsageParameters(context.WithoutCancel(ctx))
+		c.observeAuth(err)
+		if err != nil {
+			c.mu.Lock()
+			c.lastErr = err
+			c.mu.Unlock()
+
+			return nil, err
+		}
+
+		report := &usageReport{date: t, params: params, fetchedAt: time.Now()}
+
+		c.mu.Lock()
+		c.cached = report
+		c.lastErr = nil
+		c.mu.Unlock()
+
+		return report, nil
+	})
+
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*usageReport), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// fetchUsageReportOn fetches the customer usage report of date without
+// caching it. Transient errors are retried, but other dates are not tried
+// when date has no report.
+func (c *customer) fetchUsageReportOn(
+	ctx context.Context, date time.Time,
+) (*usageReport, error) {
+	day := date.Format("2006-01-02")
+
+	var params map[string]float64
+	err := retryTransient(ctx, func() error {
+		ctx, cancel := context.WithTimeout(ctx, conf.APITimeout)
+		defer cancel()
+
+		var err error
+		params, err = c.fetchUsageParametersOn(ctx, day)
+		return err
+	})
+	c.observeAuth(err)
+	if isNoDataError(err) && !errors.Is(err, errNoUsageReport) {
+		return nil, fmt.Errorf("%w for %s: %w", errNoUsageReport, day, err)
+	}
+	if err != nil {
+		return nil, explainPermissionError(err)
+	}
+
+	return &usageReport{date: date, params: params, fetchedAt: time.Now()}, nil
+}
+
+// errNotRefreshed is returned for customers whose usage report has not been
+// fetched by the background refresh yet.
+var errNotRefreshed = errors.New("usage report has not been refreshed yet")
+
+// refreshUsageReports fetches the usage report of every customer right away
+// and then every REFRESH_INTERVAL, until ctx is done, along with the quota
+// history of the report with QUOTA_HISTORY_DAYS set.
+func refreshUsageReports(ctx context.Context, customers []*customer) {
+	ticker := time.NewTicker(conf.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		collectCustomers(ctx, customers, func(
+			ctx context.Context, cust *customer,
+		) {
+			report, err := cust.refreshUsageReport(ctx)
+			if err != nil {
+				slog.Error(
+					"Failed to refresh usage report",
+					slog.String("customer_id", cust.id),
+					slog.String("err", err.Error()),
+				)
+				return
+			}
+
+			// Scrapes only read the quota history cached here, so they
+			// never call the API.
+			if conf.QuotaHistoryDays > 0 {
+				_, _, err = cust.usedQuotaDailyDelta(ctx, report)
+				if err != nil {
+					slog.Error(
+						"Failed to fetch quota history",
+						slog.String("customer_id", cust.id),
+						slog.String("err", err.Error()),
+					)
+				}
+			}
+		})
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// usedQuotaDailyDelta returns the average daily change in used quota in MB
+// between report and the most recent earlier report within the previous
+// QUOTA_HISTORY_DAYS days. It returns false when no earlier report exists.
+// Past reports never change, so they are fetched once and cached.
+func (c *customer) usedQuotaDailyDelta(
+	ctx context.Context, report *usageReport,
+) (float64, bool, error) {
+	used, ok := report.params[usedQuotaParam]
+	if !ok {
+		return 0, false, nil
+	}
+
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+
+	if c.history == nil {
+		c.history = make(map[string]float64)
+	}
+
+	// Dates sort lexically, so drop those which fell out of the window.
+	oldest := report.date.AddDate(0, 0, -conf.QuotaHistoryDays).
+		Format("2006-01-02")
+	for date := range c.history {
+		if date < oldest {
+			delete(c.history, date)
+		}
+	}
+
+	for i := 1; i <= conf.QuotaHistoryDays; i++ {
+		date := report.date.AddDate(0, 0, -i).Format("2006-01-02")
+
+		prev, ok := c.history[date]
+		if !ok {
+			var err error
+			prev, err = c.fetchUsedQuota(ctx, date)
+			if err != nil {
+				return 0, false, err
+			}
+			c.history[date] = prev
+		}
+
+		if !math.IsNaN(prev) {
+			return (used - prev) / float64(i), true, nil
+		}
+	}
+
+	return 0, false, nil
+}
+
+// cachedUsedQuotaDailyDelta is usedQuotaDailyDelta using only the quota
+// history cached by earlier calls, without calling the API. It returns false
+// when the history needed has not been fetched yet.
+func (c *customer) cachedUsedQuotaDailyDelta(
+	report *usageReport,
+) (float64, bool) {
+	used, ok := report.params[usedQuotaParam]
+	if !ok {
+		return 0, false
+	}
+
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+
+	for i := 1; i <= conf.QuotaHistoryDays; i++ {
+		date := report.date.AddDate(0, 0, -i).Format("2006-01-02")
+
+		prev, ok := c.history[date]
+		if !ok {
+			return 0, false
+		}
+		if !math.IsNaN(prev) {
+			return (used - prev) / float64(i), true
+		}
+	}
+
+	return 0, false
+}
+
+// fetchUsedQuota returns the used quota in MB reported for date, or NaN when
+// there is no report for date.
+func (c *customer) fetchUsedQuota(
+	ctx context.Context, date string,
+) (float64, error) {
+	var resp *admin.UsageReports
+	err := retryTransient(ctx, func() error {
+		ctx, cancel := context.WithTimeout(ctx, conf.APITimeout)
+		defer cancel()
+
+		var err error
+		resp, err = c.reports.Get(ctx, date)
+		return err
+	})
+	if isNoDataError(err) {
+		return math.NaN(), nil
+	}
+	if err != nil {
+		return 0, explainPermissionError(err)
+	}
+
+	for _, report := range resp.UsageReports {
+		for _, param := range report.Parameters {
+			if param.Name != usedQuotaParam {
+				continue
+			}
+			if v, ok := parameterValue(param); ok {
+				return v, nil
+			}
+		}
+	}
+
+	return math.NaN(), nil
+}
+
+// observeAuth records whether the result of an API call shows the customer's
+// OAuth token to be valid. Errors unrelated to the token leave it unchanged.
+func (c *customer) observeAuth(err error) {
+	if err == nil {
+		c.authInvalid.Store(false)
+		return
+	}
+	if !isInvalidGrantError(err) {
+		return
+	}
+
+	if !c.authInvalid.Swap(true) {
+		slog.Error(
+			"OAuth token was revoked or has expired, re-run the "+
+				"authorization flow to obtain a new token",
+			slog.String("customer_id", c.id),
+			slog.String("err", err.Error()),
+		)
+	}
+}
+
+// ready returns nil when usage stats have been fetched successfully within the
+// lookback window. It only looks at the outcome of earlier fetches, and never
+// calls the API itself, so probes stay cheap during an outage.
+func (c *customer) ready() error {
+	c.mu.Lock()
+	cached := c.cached
+	lastErr := c.lastErr
+	c.mu.Unlock()
+
+	window := time.Duration(conf.LookbackDays) * 24 * time.Hour
+	switch {
+	case cached != nil && time.Since(cached.fetchedAt) < window:
+		return nil
+	case lastErr != nil:
+		return lastErr
+	case cached != nil:
+		return errStaleReport
+	default:
+		return errNotFetched
+	}
+}
+
+// errNotFetched and errStaleReport are returned by ready for customers whose
+// usage report has not been fetched yet, or was last fetched longer ago than
+// the lookback window.
+var (
+	errNotFetched  = errors.New("usage report has not been fetched yet")
+	errStaleReport = errors.New(
+		"usage report was last fetched before the lookback window",
+	)
+)
+
+// fetchUsageParameters returns the date of the latest customer usage report
+// along with its numeric parameters keyed by name.
+func (c *customer) fetchUsageParameters(ctx context.Context) (
+	time.Time, map[string]float64, error,
+) {
+	var params map[string]float64
+
+	t, steps, err := fetchLatestReport(ctx, func(
+		ctx context.Context, date string,
+	) error {
+		var err error
+		params, err = c.fetchUsageParametersOn(ctx, date)
+		return err
+	})
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	c.lookbackSteps.Observe(float64(steps))
+
+	return t, params, nil
+}
+
+// fetchUsageParametersOn returns the numeric parameters of the customer usage
+// report of date, in YYYY-MM-DD format.
+func (c *customer) fetchUsageParametersOn(
+	ctx context.Context, date string,
+) (map[string]float64, error) {
+	resp, err := c.reports.Get(ctx, date)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.UsageReports) == 0 {
+		return nil, fmt.Errorf("%w for %s", errNoUsageReport, date)
+	}
+
+	params := make(map[string]float64)
+	for _, param := range resp.UsageReports[0].Parameters {
+		v, ok := parameterValue(param)
+		if ok {
+			params[param.Name] = v
+		}
+	}
+
+	return params, nil
+}
+
+// parameterValue returns the numeric value of a usage report parameter. Bool
+// values are mapped to 0 or 1, datetime values to Unix seconds, and string
+// values are parsed as numbers. It returns false for values which have no
+// numeric representation.
+//
+// The API omits zero values, so a parameter without any value set is an
+// integer or bool parameter with a value of 0.
+func parameterValue(param *admin.UsageReportParameters) (float64, bool) {
+	switch {
+	case len(param.MsgValue) > 0:
+		return 0, false
+	case param.StringValue != "":
+		v, err := strconv.ParseFloat(param.StringValue, 64)
+		if err != nil {
+			return 0, false
+		}
+		return v, true
+	case param.DatetimeValue != "":
+		t, err := time.Parse(time.RFC3339, param.DatetimeValue)
+		if err != nil {
+			return 0, false
+		}
+		return float64(t.Unix()), true
+	case param.BoolValue:
+		return 1, true
+	default:
+		return float64(param.IntValue), true
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	admin "google.golang.org/api/admin/reports/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// fakeUsageReports implements UsageReportsGetter with a function.
+type fakeUsageReports func(
+	ctx context.Context, date string,
+) (*admin.UsageReports, error)
+
+func (f fakeUsageReports) Get(
+	ctx context.Context, date string,
+) (*admin.UsageReports, error) {
+	return f(ctx, date)
+}
+
+// newTestCustomer returns a customer whose usage reports are fetched from
+// reports.
+func newTestCustomer(reports UsageReportsGetter) *customer {
+	return &customer{
+		id:            "test",
+		reports:       reports,
+		lookbackSteps: prometheus.ObserverFunc(func(float64) {}),
+		cacheHits: prometheus.NewCounter(
+			prometheus.CounterOpts{Name: "cache_hits_total"},
+		),
+		cacheMisses: prometheus.NewCounter(
+			prometheus.CounterOpts{Name: "cache_misses_total"},
+		),
+	}
+}
+
+// testUsageReports returns a customer usage report holding the integer
+// parameters in params.
+func testUsageReports(params map[string]int64) *admin.UsageReports {
+	report := &admin.UsageReport{}
+	for name, v := range params {
+		report.Parameters = append(
+			report.Parameters,
+			&admin.UsageReportParameters{Name: name, IntValue: v},
+		)
+	}
+
+	return &admin.UsageReports{UsageReports: []*admin.UsageReport{report}}
+}
+
+func TestFetchUsageParametersEmptyLatestReport(t *testing.T) {
+	setConf(t, func(c *config) { c.ReportProbeLatest = false })
+
+	now := time.Now()
+	latest := reportDate(now, -1).Format("2006-01-02")
+	want := reportDate(now, -2)
+
+	cust := newTestCustomer(fakeUsageReports(func(
+		_ context.Context, date string,
+	) (*admin.UsageReports, error) {
+		if date == latest {
+			return &admin.UsageReports{}, nil
+		}
+
+		return testUsageReports(map[string]int64{usedQuotaParam: 42}), nil
+	}))
+	var steps []float64
+	cust.lookbackSteps = prometheus.ObserverFunc(func(v float64) {
+		steps = append(steps, v)
+	})
+
+	date, params, err := cust.fetchUsageParameters(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !date.Equal(want) {
+		t.Errorf("got report date %s, want %s", date, want)
+	}
+	if params[usedQuotaParam] != 42 {
+		t.Errorf(
+			"got %s of %v, want 42", usedQuotaParam, params[usedQuotaParam],
+		)
+	}
+	if len(steps) != 1 || steps[0] != 2 {
+		t.Errorf("observed lookback steps %v, want [2]", steps)
+	}
+}
+
+func TestParameterValue(t *testing.T) {
+	tests := []struct {
+		name   string
+		param  *admin.UsageReportParameters
+		want   float64
+		wantOK bool
+	}{
+		{
+			name:   "int",
+			param:  &admin.UsageReportParameters{IntValue: 42},
+			want:   42,
+			wantOK: true,
+		},
+		{
+			name:   "omitted zero",
+			param:  &admin.UsageReportParameters{},
+			want:   0,
+			wantOK: true,
+		},
+		{
+			name:   "bool",
+			param:  &admin.UsageReportParameters{BoolValue: true},
+			want:   1,
+			wantOK: true,
+		},
+		{
+			name:   "numeric string",
+			param:  &admin.UsageReportParameters{StringValue: "1.5"},
+			want:   1.5,
+			wantOK: true,
+		},
+		{
+			name:  "non-numeric string",
+			param: &admin.UsageReportParameters{StringValue: "drive"},
+		},
+		{
+			name: "datetime",
+			param: &admin.UsageReportParameters{
+				DatetimeValue: "2024-01-02T03:04:05Z",
+			},
+			want:   1704164645,
+			wantOK: true,
+		},
+		{
+			name:  "invalid datetime",
+			param: &admin.UsageReportParameters{DatetimeValue: "yesterday"},
+		},
+		{
+			name: "message",
+			param: &admin.UsageReportParameters{
+				MsgValue: []googleapi.RawMessage{[]byte(`{}`)},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parameterValue(tt.param)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf(
+					"got %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK,
+				)
+			}
+		})
+	}
+}
+
+func TestLookupUsageReportRefreshError(t *testing.T) {
+	setConf(t, func(c *config) { c.RefreshInterval = time.Hour })
+
+	cust := newTestCustomer(fakeUsageReports(func(
+		context.Context, string,
+	) (*admin.UsageReports, error) {
+		t.Error("usage report fetched with REFRESH_INTERVAL set")
+		return nil, errors.New("unexpected fetch")
+	}))
+
+	_, fromCache, err := cust.lookupUsageReport(context.Background())
+	if !errors.Is(err, errNotRefreshed) || fromCache {
+		t.Errorf(
+			"got %v, %v before a refresh, want %v, false",
+			fromCache, err, errNotRefreshed,
+		)
+	}
+
+	refreshErr := errors.New("refresh failed")
+	cust.lastErr = refreshErr
+	_, fromCache, err = cust.lookupUsageReport(context.Background())
+	if !errors.Is(err, refreshErr) || !fromCache {
+		t.Errorf(
+			"got %v, %v after a failed refresh, want %v, true",
+			fromCache, err, refreshErr,
+		)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/csv"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+// exportCSVHeader is the header row of the CSV export. Quota is in bytes, and
+// in TB as on the stats page.
+var exportCSVHeader = []string{
+	"customer_id", "date", "service",
+	"total_quota_bytes", "used_quota_bytes",
+	"total_quota_tb", "used_quota_tb", "percentage_used",
+}
+
+// exportCSVHandlerFunc responds with the quota stats of every customer as a
+// CSV download. Each customer has a row for its overall quota, followed by a
+// row per service with the used quota and the service's own limit, if any.
+// Cached usage reports are used when they are fresh enough.
+func exportCSVHandlerFunc(collector *QuotaCollector) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		rows := [][]string{exportCSVHeader}
+
+		for _, cust := range collector.customers {
+			report, err := cust.cachedUsageReport(req.Context())
+			if err == nil {
+				_, _, _, err = report.quotaStats()
+			}
+			if err != nil {
+				slog.Error(
+					"Failed to fetch quota stats",
+					slog.String("customer_id", cust.id),
+					slog.String("err", err.Error()),
+				)
+				http.Error(
+					w, "Failed to fetch quota stats: "+errorSummary(err),
+					http.StatusInternalServerError,
+				)
+				return
+			}
+
+			rows = append(rows, exportCSVRows(cust.id, report)...)
+		}
+
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set(
+			"Content-Disposition", `attachment; filename="quota.csv"`,
+		)
+		_ = csv.NewWriter(w).WriteAll(rows)
+	}
+}
+
+// exportCSVRows returns the CSV rows of a customer's usage report, which must
+// hold the quota parameters.
+func exportCSVRows(customerID string, report *usageReport) [][]string {
+	date := report.date.Format("2006-01-02")
+	total, used, percentage, _ := report.quotaStats()
+
+	rows := [][]string{{
+		customerID, date, "total",
+		exportBytes(total), exportBytes(used),
+		exportTB(total), exportTB(used),
+		strconv.FormatFloat(percentage, 'f', 2, 64),
+	}}
+
+	for _, service := range slices.Sorted(maps.Keys(serviceUsedQuotaParams)) {
+		used, ok := report.params[serviceUsedQuotaParams[service]]
+		if !ok {
+			continue
+		}
+
+		row := []string{
+			customerID, date, service,
+			"", exportBytes(used), "", exportTB(used), "",
+		}
+		limit, ok := report.params[serviceQuotaLimitParams[service]]
+		if ok && limit >= 0 {
+			row[3] = exportBytes(limit)
+			row[5] = exportTB(limit)
+			if limit > 0 {
+				row[7] = strconv.FormatFloat(used/limit*100, 'f', 2, 64)
+			}
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows
+}
+
+// exportBytes formats quota in MB as bytes.
+func exportBytes(mb float64) string {
+	return strconv.FormatInt(int64(mb)*1048576, 10)
+}
+
+// exportTB formats quota in MB as TB.
+func exportTB(mb float64) string {
+	return strconv.FormatFloat(mb/1048576, 'f', 3, 64)
+}
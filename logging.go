@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// statusRecorder records the status code written to a http.ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// logRequests logs each request served by next. Successful requests are
+// logged at debug level so frequent scrapes and probes do not flood the log,
+// while failed requests are logged at info level.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rec, r)
+
+		level := slog.LevelDebug
+		if rec.status >= http.StatusBadRequest {
+			level = slog.LevelInfo
+		}
+
+		slog.Log(
+			r.Context(), level, "Served request",
+			slog.String("method", r.Method),
+			slog.String("url", redactedURL(r)),
+			slog.Int("status", rec.status),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("remote_addr", r.RemoteAddr),
+		)
+	})
+}
+
+// redactedURL returns the request URL with the token query parameter redacted.
+func redactedURL(r *http.Request) string {
+	q := r.URL.Query()
+	if !q.Has("token") {
+		return r.URL.RequestURI()
+	}
+
+	q.Set("token", "REDACTED")
+	u := *r.URL
+	u.RawQuery = q.Encode()
+
+	return u.RequestURI()
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// loginActivityMaxResults is the largest page size accepted by the activities
+// API.
+const loginActivityMaxResults = 1000
+
+// loginEventResults maps login audit event names to the result label they are
+// counted under.
+var loginEventResults = map[string]string{
+	"login_success": "success",
+	"login_failure": "failure",
+}
+
+// loginEventCounts holds the running login event totals of a customer, and
+// the end of the time window they have been counted up to.
+type loginEventCounts struct {
+	since  time.Time
+	counts map[string]float64
+}
+
+type LoginActivityCollector struct {
+	events    *prometheus.Desc
+	customers []*customer
+
+	mu    sync.Mutex
+	state map[*customer]*loginEventCounts
+}
+
+func NewLoginActivityCollector(
+	namespace string, customers []*customer,
+) *LoginActivityCollector {
+	now := time.Now().Add(-conf.LoginEventsLag)
+	state := make(map[*customer]*loginEventCounts, len(customers))
+	for _, cust := range customers {
+		state[cust] = &loginEventCounts{
+			since:  now,
+			counts: make(map[string]float64),
+		}
+	}
+
+	return &LoginActivityCollector{
+		events: prometheus.NewDesc(namespace+"_login_events_total",
+			"Number of login events by result since the exporter started, "+
+				"counted up to LOGIN_EVENTS_LAG ago",
+			[]string{"customer_id", "result"}, conf.ConstLabels,
+		),
+		customers: customers,
+		state:     state,
+	}
+}
+
+func (c *LoginActivityCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.events
+}
+
+func (c *LoginActivityCollector) Collect(ch chan<- prometheus.Metric) {
+	c.CollectWithContext(context.Background(), ch)
+}
+
+func (c *LoginActivityCollector) CollectWithContext(
+	ctx context.Context, ch chan<- prometheus.Metric,
+) {
+	// Holding the lock across the fetch ensures concurrent scrapes never
+	// count the same time window twice. Each customer only touches its own
+	// state, so customers can be fetched concurrently.
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	collectCustomers(ctx, c.customers, func(
+		ctx context.Context, cust *customer,
+	) {
+		state := c.state[cust]
+
+		err := c.updateCounts(ctx, cust, state)
+		cust.observeAuth(err)
+		if err != nil {
+			slog.Error(
+				"Failed to fetch login activity",
+				slog.String("customer_id", cust.id),
+				slog.String("err", err.Error()),
+			)
+		}
+
+		for _, result := range loginEventResults {
+			ch <- prometheus.MustNewConstMetric(
+				c.events, prometheus.CounterValue, state.counts[result],
+				cust.id, result,
+			)
+		}
+	})
+}
+
+// updateCounts adds the login events which occurred between state.since and
+// LOGIN_EVENTS_LAG before now to state. The counts are only updated once every
+// page of the window has been fetched with fetchPages, so a failed fetch is
+// retried in full on the next scrape.
+func (c *LoginActivityCollector) updateCounts(
+	ctx context.Context, cust *customer, state *loginEventCounts,
+) error {
+	end := time.Now().Add(-conf.LoginEventsLag)
+	counts := make(map[string]float64)
+
+	_, err := fetchPages(ctx, "Login activity report", func(
+		ctx context.Context, pageToken string,
+	) (string, error) {
+		call := cust.client.Activities.List("all", "login").
+			StartTime(state.since.Format(time.RFC3339)).
+			EndTime(end.Format(time.RFC3339)).
+			MaxResults(loginActivityMaxResults)
+		if cust.customerID != "" {
+			call = call.CustomerId(cust.customerID)
+		}
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+
+		resp, err := call.Context(ctx).Do()
+		if err != nil {
+			return "", err
+		}
+
+		for _, activity := range resp.Items {
+			for _, event := range activity.Events {
+				result, ok := loginEventResults[event.Name]
+				if ok {
+					counts[result]++
+				}
+			}
+		}
+
+		return resp.NextPageToken, nil
+	})
+	if err != nil {
+		return explainPermissionError(err)
+	}
+
+	for result, n := range counts {
+		state.counts[result] += n
+	}
+	state.since = end
+
+	return nil
+}
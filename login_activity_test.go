@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoginActivityRepeatedPageToken(t *testing.T) {
+	var pages atomic.Int32
+	cust := &customer{
+		id: "test",
+		client: newTestAdminService(t, func(
+			w http.ResponseWriter, _ *http.Request,
+		) {
+			pages.Add(1)
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w,
+				`{"items":[{"events":[{"name":"login_success"}]}],`+
+					`"nextPageToken":"page-2"}`,
+			)
+		}),
+	}
+	collector := NewLoginActivityCollector("test", []*customer{cust})
+	state := collector.state[cust]
+	since := state.since
+
+	err := collector.updateCounts(context.Background(), cust, state)
+	if err == nil || !strings.Contains(err.Error(), "more than once") {
+		t.Fatalf("got error %v, want a repeated page token error", err)
+	}
+	if got := pages.Load(); got != 2 {
+		t.Errorf("fetched %d pages, want 2", got)
+	}
+	if len(state.counts) != 0 || !state.since.Equal(since) {
+		t.Errorf(
+			"state changed to %v since %s after a failed fetch",
+			state.counts, state.since.Format(time.RFC3339),
+		)
+	}
+}
@@ -1,247 +1,2633 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"html/template"
+	"io"
+	"io/fs"
 	"log"
 	"log/slog"
+	"math"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
 	"time"
 
 	_ "embed"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sethvargo/go-envconfig"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
+	"golang.org/x/term"
+	"golang.org/x/time/rate"
 	admin "google.golang.org/api/admin/reports/v1"
-	"google.golang.org/api/option"
+	"google.golang.org/api/googleapi"
 )
 
 type config struct {
-	WebAuth         string `env:"WEB_AUTH"`
-	MetricsAuth     string `env:"METRICS_AUTH"`
+	WebAuth     string `env:"WEB_AUTH" redact:"true"`
+	MetricsAuth string `env:"METRICS_AUTH" redact:"true"`
+	// BasicAuthUsername and BasicAuthPassword allow HTTP basic auth on the
+	// metrics endpoint, as an alternative to METRICS_AUTH.
+	BasicAuthUsername string `env:"BASIC_AUTH_USERNAME"`
+	BasicAuthPassword string `env:"BASIC_AUTH_PASSWORD" redact:"true"`
+	// RequireAuth refuses to start unless both WebAuth and MetricsAuth are
+	// set, rather than serving their endpoints without authentication.
+	RequireAuth bool `env:"REQUIRE_AUTH, default=false"`
+	// CredentialsJSON holds the credentials inline and takes precedence over
+	// CredentialsFile, which is only read when CredentialsJSON is empty.
+	// CredentialsFile may be a comma separated list during a key rotation,
+	// in which case the first file whose credentials authenticate is used.
+	CredentialsJSON string `env:"CREDENTIALS_JSON" redact:"true"`
 	CredentialsFile string `env:"CREDENTIALS_FILE, default=credentials.json"`
-	TokenFile       string `env:"TOKEN_FILE, default=token.json"`
-	Port            int    `env:"PORT, default=8080"`
+	// TokenJSON holds the OAuth token inline and takes precedence over
+	// TokenFile, which is only read when TokenJSON is empty.
+	TokenJSON string `env:"TOKEN_JSON" redact:"true"`
+	TokenFile string `env:"TOKEN_FILE, default=token.json"`
+	// SecondaryTokenFile holds a token to fall back to when the token above
+	// is missing or can no longer be refreshed, so a new token can be put in
+	// place without a restart.
+	SecondaryTokenFile string `env:"SECONDARY_TOKEN_FILE"`
+	// AuthTimeout limits how long the interactive OAuth flow waits for the
+	// user to authorize access.
+	AuthTimeout time.Duration `env:"AUTH_TIMEOUT, default=5m"`
+	// ImpersonateSubject is the admin user to impersonate when
+	// CredentialsFile is a service account key with domain-wide delegation.
+	ImpersonateSubject string `env:"IMPERSONATE_SUBJECT"`
+	// UseADC authenticates with Application Default Credentials instead of
+	// the credentials above. They are also used when CredentialsJSON is
+	// empty and CredentialsFile does not exist.
+	UseADC bool `env:"USE_ADC, default=false"`
+	// OAuthScopes replaces the OAuth scopes requested for the enabled
+	// collectors when set.
+	OAuthScopes []string `env:"OAUTH_SCOPES"`
+	// OAuthRedirectURL picks which authorized redirect URI of a web
+	// application OAuth client the consent flow redirects to, the first one
+	// in the credentials when empty. Desktop app clients use a loopback
+	// redirect of their own instead.
+	OAuthRedirectURL string `env:"OAUTH_REDIRECT_URL"`
+	// CustomerID is the Google customer ID to report on, for resellers whose
+	// credentials are not tied to that customer.
+	CustomerID string `env:"CUSTOMER_ID"`
+	// ListenAddress is the host to listen on, all interfaces when empty. It
+	// may also be a full host:port, in which case Port is ignored.
+	ListenAddress string `env:"LISTEN_ADDRESS"`
+	Port          int    `env:"PORT, default=8080"`
+	LookbackDays  int    `env:"LOOKBACK_DAYS, default=5"`
+	// ReportProbeLatest starts looking for reports at today rather than
+	// yesterday, to use the latest available report as soon as it exists.
+	ReportProbeLatest bool   `env:"REPORT_PROBE_LATEST, default=false"`
+	CollectUserQuota  bool   `env:"COLLECT_USER_QUOTA, default=false"`
+	TLSCertFile       string `env:"TLS_CERT_FILE"`
+	TLSKeyFile        string `env:"TLS_KEY_FILE"`
+	// ClientCAFile is a PEM file of CA certificates, which scrapers of the
+	// metrics endpoint must present a client certificate signed by.
+	ClientCAFile string        `env:"CLIENT_CA_FILE"`
+	CacheTTL     time.Duration `env:"CACHE_TTL, default=1h"`
+	// RefreshInterval fetches the customer usage reports, and the quota
+	// history with QuotaHistoryDays, in the background at this interval
+	// when set, so scrapes and the stats pages are always served from the
+	// cache instead of waiting on the API. CacheTTL does not apply then.
+	RefreshInterval time.Duration `env:"REFRESH_INTERVAL, default=0"`
+	// WebRateLimit is the number of requests per minute each stats endpoint
+	// serves before falling back to the last fetched stats, or rejecting
+	// the request for /refresh. Zero disables rate limiting.
+	WebRateLimit    int  `env:"WEB_RATE_LIMIT, default=60"`
+	CollectDrive    bool `env:"COLLECT_DRIVE, default=false"`
+	CollectMeet     bool `env:"COLLECT_MEET, default=false"`
+	CollectCalendar bool `env:"COLLECT_CALENDAR, default=false"`
+	// CollectSharedDrives exposes the entity usage report parameters of
+	// each shared drive.
+	CollectSharedDrives bool `env:"COLLECT_SHARED_DRIVES, default=false"`
+	// LoginEventsLag is how far behind now login events are counted up to,
+	// as the activities API only receives events minutes to hours after
+	// they happened, and events arriving for an already counted window are
+	// never counted.
+	LoginEventsLag time.Duration `env:"LOGIN_EVENTS_LAG, default=1h"`
+	// CollectLoginEvents requires the admin.reports.audit.readonly scope in
+	// addition to the usage reports scope.
+	CollectLoginEvents bool          `env:"COLLECT_LOGIN_EVENTS, default=false"`
+	MetricNamespace    string        `env:"METRIC_NAMESPACE, default=google_workspace"`
+	LogLevel           string        `env:"LOG_LEVEL, default=info"`
+	LogFormat          string        `env:"LOG_FORMAT, default=text"`
+	APITimeout         time.Duration `env:"API_TIMEOUT, default=15s"`
+	APIMaxRetries      int           `env:"API_MAX_RETRIES, default=3"`
+	APIRetryBaseDelay  time.Duration `env:"API_RETRY_BASE_DELAY, default=1s"`
+	// CollectConcurrency limits how many customers each collector fetches
+	// concurrently during a scrape. Collectors themselves run concurrently.
+	CollectConcurrency int `env:"COLLECT_CONCURRENCY, default=4"`
+	// QuotaHistoryDays is how many days before the latest report to look
+	// for an earlier report to compute the daily used quota delta from.
+	// Zero disables the delta metric.
+	QuotaHistoryDays int `env:"QUOTA_HISTORY_DAYS, default=0"`
+	// CustomersFile is a JSON file listing the customers to collect usage
+	// for. When empty, a single customer is configured from the credentials
+	// and token settings above.
+	CustomersFile string `env:"CUSTOMERS_FILE"`
+	// ReportTimezone is the IANA time zone whose day boundaries are used to
+	// pick the usage report dates to request.
+	ReportTimezone timezone `env:"REPORT_TIMEZONE, default=UTC"`
+	// RoutePrefix is prepended to all routes, for serving behind a reverse
+	// proxy under a subpath.
+	RoutePrefix string `env:"ROUTE_PREFIX"`
+	// HTTP server timeouts, where zero means no timeout. WriteTimeout must
+	// allow for a scrape which retries across the whole lookback window.
+	HTTPReadHeaderTimeout time.Duration `env:"HTTP_READ_HEADER_TIMEOUT, default=10s"`
+	HTTPReadTimeout       time.Duration `env:"HTTP_READ_TIMEOUT, default=30s"`
+	HTTPWriteTimeout      time.Duration `env:"HTTP_WRITE_TIMEOUT, default=2m"`
+	HTTPIdleTimeout       time.Duration `env:"HTTP_IDLE_TIMEOUT, default=2m"`
+	// MetricsTimeout and WebTimeout cap how long requests to the metrics
+	// endpoint and to the stats endpoints may run before they are answered
+	// with 503 Service Unavailable, where zero means no timeout. Scrapes may
+	// fetch every customer when the cache is cold, so they get longer.
+	MetricsTimeout time.Duration `env:"METRICS_TIMEOUT, default=90s"`
+	WebTimeout     time.Duration `env:"WEB_TIMEOUT, default=30s"`
+	// Offline serves synthetic usage reports instead of calling the Google
+	// APIs, so no credentials are needed.
+	Offline             bool    `env:"OFFLINE, default=false"`
+	OfflineTotalQuotaMB float64 `env:"OFFLINE_TOTAL_QUOTA_MB, default=1048576"`
+	OfflineUsedQuotaMB  float64 `env:"OFFLINE_USED_QUOTA_MB, default=524288"`
+	// QuotaUnit is the unit quota metrics are exposed in, one of bytes, mb
+	// or gb. It is part of the metric names, such as quota_bytes_total.
+	QuotaUnit quotaUnit `env:"QUOTA_UNIT, default=bytes"`
+	// UsageParameters lists the usage report parameters to expose, replacing
+	// the built-in usage metrics and COLLECT_* groups when set. Each is
+	// exposed as a metric named after the parameter.
+	UsageParameters []string `env:"USAGE_PARAMETERS"`
+	// UsageApps lists applications, such as classroom, whose usage report
+	// parameters are all exposed, each as a metric named after the
+	// parameter. It cannot be combined with USAGE_PARAMETERS, which limits
+	// the parameters fetched.
+	UsageApps []string `env:"USAGE_APPS"`
+	// UserUsageParameters lists user usage report parameters to request and
+	// expose per user with COLLECT_USER_QUOTA, in addition to the used
+	// quota. Each is exposed as a metric named after the parameter.
+	UserUsageParameters []string `env:"USER_USAGE_PARAMETERS"`
+	// OrgUnitIDs lists the organizational units to expose the summed used
+	// quota of their users for.
+	OrgUnitIDs []string `env:"ORG_UNIT_IDS"`
+	// MaxSeries caps the number of per-user series exposed for each
+	// customer, keeping the users with the most used quota. Zero disables
+	// the cap.
+	MaxSeries int `env:"MAX_SERIES, default=10000"`
+	// UserReportMaxPages caps the number of pages fetched from the user and
+	// entity usage reports and activities APIs for a single report, guarding
+	// against a paging loop which never ends. Each page holds up to 1000
+	// users, shared drives or login activities.
+	UserReportMaxPages int `env:"USER_REPORT_MAX_PAGES, default=1000"`
+	// ConstLabels are static labels added to every exposed metric, given as
+	// a comma separated list of name=value pairs, such as
+	// environment=prod,region=us.
+	ConstLabels map[string]string `env:"CONST_LABELS, separator=="`
+	// IncludeRuntimeMetrics exposes the Go runtime and process metrics along
+	// with the Workspace metrics.
+	IncludeRuntimeMetrics bool `env:"INCLUDE_RUNTIME_METRICS, default=true"`
+	// ReportTimestamps stamps the quota and usage metrics with the date of
+	// the usage report they are from, instead of leaving Prometheus to use
+	// the scrape time. Reports are usually days old, so Prometheus rejects
+	// these samples unless its out_of_order_time_window covers the lookback
+	// window, and the series never appear in instant queries over recent
+	// data, as they are older than the lookback delta of 5 minutes.
+	ReportTimestamps bool `env:"REPORT_TIMESTAMPS, default=false"`
+	// StatsTemplateFile is a html/template file to render the stats page
+	// with instead of the embedded template. It is executed with QuotaStats.
+	StatsTemplateFile string `env:"STATS_TEMPLATE_FILE"`
+	// UnauthorizedTemplateFile is a html/template file to render the 401
+	// response of the stats page with instead of the embedded template. It
+	// is executed with UnauthorizedPage.
+	UnauthorizedTemplateFile string `env:"UNAUTHORIZED_TEMPLATE_FILE"`
+	// StatsPrecision is the number of decimal places of the quota shown on
+	// the stats page.
+	StatsPrecision int `env:"STATS_PRECISION, default=2"`
+	// UserAgent identifies the exporter in requests to the Google APIs,
+	// defaulting to go-google-admin-metrics/<version>.
+	UserAgent string `env:"USER_AGENT"`
+	// EnablePprof serves the net/http/pprof profiles under /debug/pprof/,
+	// behind WEB_AUTH.
+	EnablePprof bool `env:"ENABLE_PPROF, default=false"`
+	// OTelEnabled exports OpenTelemetry traces of the quota stats fetches
+	// and Google API requests over OTLP/HTTP, configured by the standard
+	// OTEL_EXPORTER_OTLP_* environment variables.
+	OTelEnabled bool `env:"OTEL_ENABLED, default=false"`
+}
+
+// timezone is a time.Location decoded from an IANA time zone name.
+type timezone struct {
+	loc *time.Location
+}
+
+func (tz *timezone) EnvDecode(val string) error {
+	loc, err := time.LoadLocation(val)
+	if err != nil {
+		return fmt.Errorf("Invalid REPORT_TIMEZONE %q: %w", val, err)
+	}
+	tz.loc = loc
+
+	return nil
+}
+
+// quotaUnit is a unit for quota metrics, which the API reports in MB.
+type quotaUnit struct {
+	// name is the unit used in metric names and help texts.
+	name string
+	// perMB is the number of units in one MB.
+	perMB float64
+}
+
+// quotaUnits maps QUOTA_UNIT values to their units.
+var quotaUnits = map[string]quotaUnit{
+	"bytes": {name: "bytes", perMB: 1048576},
+	"mb":    {name: "megabytes", perMB: 1},
+	"gb":    {name: "gigabytes", perMB: 1.0 / 1024},
+}
+
+func (u *quotaUnit) EnvDecode(val string) error {
+	unit, ok := quotaUnits[strings.ToLower(val)]
+	if !ok {
+		return fmt.Errorf(
+			"Invalid QUOTA_UNIT %q, must be one of bytes, mb or gb", val,
+		)
+	}
+	*u = unit
+
+	return nil
+}
+
+// fromMB converts v from MB to the unit.
+func (u quotaUnit) fromMB(v float64) float64 {
+	return v * u.perMB
+}
+
+func (u quotaUnit) MarshalText() ([]byte, error) {
+	for key, unit := range quotaUnits {
+		if unit == u {
+			return []byte(key), nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (tz timezone) MarshalText() ([]byte, error) {
+	return []byte(tz.location().String()), nil
+}
+
+// location returns the time zone's location, defaulting to UTC.
+func (tz timezone) location() *time.Location {
+	if tz.loc == nil {
+		return time.UTC
+	}
+
+	return tz.loc
+}
+
+// customerIDRE loosely matches Google customer IDs, such as C01abcd2e.
+var customerIDRE = regexp.MustCompile(`^C[0-9A-Za-z]+$`)
+
+// usageParameterRE matches usage report parameter names, such as
+// gmail:num_emails_sent.
+var usageParameterRE = regexp.MustCompile(`^[a-z0-9_]+:[a-z0-9_]+$`)
+
+// metricNamespaceRE matches valid Prometheus metric name prefixes.
+var metricNamespaceRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+func (c *config) validate() error {
+	if c.RequireAuth && (c.WebAuth == "" || c.MetricsAuth == "" &&
+		c.BasicAuthUsername == "" && c.ClientCAFile == "") {
+		return errors.New(
+			"REQUIRE_AUTH is set, but WEB_AUTH or all of METRICS_AUTH, " +
+				"BASIC_AUTH_USERNAME and CLIENT_CA_FILE are empty",
+		)
+	}
+
+	if (c.BasicAuthUsername == "") != (c.BasicAuthPassword == "") {
+		return errors.New(
+			"BASIC_AUTH_USERNAME and BASIC_AUTH_PASSWORD must be set " +
+				"together",
+		)
+	}
+
+	err := c.validateListenAddress()
+	if err != nil {
+		return err
+	}
+
+	if c.LookbackDays < 1 {
+		return fmt.Errorf(
+			"LOOKBACK_DAYS must be at least 1, got %d", c.LookbackDays,
+		)
+	}
+
+	if !metricNamespaceRE.MatchString(c.MetricNamespace) {
+		return fmt.Errorf(
+			"METRIC_NAMESPACE %q is not a valid metric name prefix",
+			c.MetricNamespace,
+		)
+	}
+
+	for _, param := range c.UsageParameters {
+		if !usageParameterRE.MatchString(param) {
+			return fmt.Errorf(
+				"USAGE_PARAMETERS entry %q is not a valid parameter name",
+				param,
+			)
+		}
+	}
+	// A repeated parameter would expose the same series twice, which fails
+	// every scrape.
+	slices.Sort(c.UsageParameters)
+	c.UsageParameters = slices.Compact(c.UsageParameters)
+
+	if c.StatsPrecision < 0 || c.StatsPrecision > 10 {
+		return fmt.Errorf(
+			"STATS_PRECISION must be between 0 and 10, got %d",
+			c.StatsPrecision,
+		)
+	}
+
+	for _, app := range c.UsageApps {
+		if !usageAppRE.MatchString(app) {
+			return fmt.Errorf(
+				"USAGE_APPS entry %q is not a valid application name", app,
+			)
+		}
+	}
+	if len(c.UsageApps) > 0 && len(c.UsageParameters) > 0 {
+		return errors.New(
+			"USAGE_APPS cannot be combined with USAGE_PARAMETERS",
+		)
+	}
+
+	for _, param := range c.UserUsageParameters {
+		if !usageParameterRE.MatchString(param) {
+			return fmt.Errorf(
+				"USER_USAGE_PARAMETERS entry %q is not a valid parameter "+
+					"name",
+				param,
+			)
+		}
+	}
+	slices.Sort(c.UserUsageParameters)
+	c.UserUsageParameters = slices.Compact(c.UserUsageParameters)
+
+	slices.Sort(c.OrgUnitIDs)
+	c.OrgUnitIDs = slices.Compact(c.OrgUnitIDs)
+
+	for _, scope := range c.OAuthScopes {
+		if scope == "" {
+			return errors.New("OAUTH_SCOPES must not contain empty entries")
+		}
+	}
+
+	if c.OAuthRedirectURL != "" {
+		u, err := url.Parse(c.OAuthRedirectURL)
+		if err != nil || !u.IsAbs() || u.Host == "" {
+			return fmt.Errorf(
+				"OAUTH_REDIRECT_URL must be an absolute URL, got %q",
+				c.OAuthRedirectURL,
+			)
+		}
+	}
+
+	if c.CustomerID != "" && !customerIDRE.MatchString(c.CustomerID) {
+		return fmt.Errorf(
+			"CUSTOMER_ID %q is not a valid customer ID", c.CustomerID,
+		)
+	}
+
+	if c.WebRateLimit < 0 {
+		return fmt.Errorf(
+			"WEB_RATE_LIMIT must not be negative, got %d", c.WebRateLimit,
+		)
+	}
+
+	if c.CollectConcurrency < 1 {
+		return fmt.Errorf(
+			"COLLECT_CONCURRENCY must be at least 1, got %d",
+			c.CollectConcurrency,
+		)
+	}
+
+	if c.RefreshInterval < 0 {
+		return fmt.Errorf(
+			"REFRESH_INTERVAL must not be negative, got %s", c.RefreshInterval,
+		)
+	}
+
+	if c.QuotaHistoryDays < 0 {
+		return fmt.Errorf(
+			"QUOTA_HISTORY_DAYS must not be negative, got %d",
+			c.QuotaHistoryDays,
+		)
+	}
+
+	if c.MaxSeries < 0 {
+		return fmt.Errorf(
+			"MAX_SERIES must not be negative, got %d", c.MaxSeries,
+		)
+	}
+
+	for name := range c.ConstLabels {
+		if !labelNameRE.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("CONST_LABELS has invalid label name %q", name)
+		}
+		if reservedLabelNames[name] {
+			return fmt.Errorf(
+				"CONST_LABELS label %s is already used by the exporter",
+				name,
+			)
+		}
+	}
+
+	if c.LoginEventsLag < 0 {
+		return fmt.Errorf(
+			"LOGIN_EVENTS_LAG must not be negative, got %s", c.LoginEventsLag,
+		)
+	}
+
+	if c.MetricsTimeout < 0 || c.WebTimeout < 0 {
+		return errors.New(
+			"METRICS_TIMEOUT and WEB_TIMEOUT must not be negative",
+		)
+	}
+
+	if c.UserReportMaxPages < 1 {
+		return fmt.Errorf(
+			"USER_REPORT_MAX_PAGES must be at least 1, got %d",
+			c.UserReportMaxPages,
+		)
+	}
+
+	if c.APIMaxRetries < 0 {
+		return fmt.Errorf(
+			"API_MAX_RETRIES must not be negative, got %d", c.APIMaxRetries,
+		)
+	}
+
+	if c.Offline {
+		if c.OfflineTotalQuotaMB <= 0 || c.OfflineUsedQuotaMB < 0 {
+			return errors.New(
+				"OFFLINE_TOTAL_QUOTA_MB must be positive and " +
+					"OFFLINE_USED_QUOTA_MB must not be negative",
+			)
+		}
+		if c.CollectUserQuota || c.CollectLoginEvents ||
+			c.CollectSharedDrives || len(c.OrgUnitIDs) > 0 {
+			return errors.New(
+				"COLLECT_USER_QUOTA, COLLECT_LOGIN_EVENTS, " +
+					"COLLECT_SHARED_DRIVES and ORG_UNIT_IDS are not " +
+					"supported in OFFLINE mode",
+			)
+		}
+	}
+
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return errors.New(
+			"TLS_CERT_FILE and TLS_KEY_FILE must be set together",
+		)
+	}
+
+	if c.ClientCAFile != "" && c.TLSCertFile == "" {
+		return errors.New("CLIENT_CA_FILE requires TLS_CERT_FILE")
+	}
+
+	return nil
+}
+
+// errNoUsageReport is returned when the API responds successfully but without
+// any usage report for the requested date.
+var errNoUsageReport = errors.New("no usage report available")
+
+// errMissingParameter is returned when a usage report lacks a parameter
+// required to compute the quota stats.
+var errMissingParameter = errors.New("usage report parameter missing")
+
+// listenAddress returns the host:port to listen on.
+func (c *config) listenAddress() string {
+	_, _, err := net.SplitHostPort(c.ListenAddress)
+	if err == nil {
+		return c.ListenAddress
+	}
+
+	return net.JoinHostPort(c.ListenAddress, strconv.Itoa(c.Port))
+}
+
+// listenHostRE matches host names which may be listened on.
+var listenHostRE = regexp.MustCompile(`^[A-Za-z0-9.-]+$`)
+
+// validateListenAddress checks that LISTEN_ADDRESS and PORT make up a valid
+// address to listen on.
+func (c *config) validateListenAddress() error {
+	if _, _, err := net.SplitHostPort(c.ListenAddress); err != nil &&
+		(c.Port < 1 || c.Port > 65535) {
+		return fmt.Errorf("PORT must be between 1 and 65535, got %d", c.Port)
+	}
+
+	host, port, err := net.SplitHostPort(c.listenAddress())
+	if err != nil {
+		return fmt.Errorf(
+			"LISTEN_ADDRESS %q is not a valid address: %w",
+			c.ListenAddress, err,
+		)
+	}
+
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf(
+			"LISTEN_ADDRESS %q has invalid port %q, it must be between 1 "+
+				"and 65535",
+			c.ListenAddress, port,
+		)
+	}
+
+	if host != "" && net.ParseIP(host) == nil &&
+		!listenHostRE.MatchString(host) {
+		return fmt.Errorf(
+			"LISTEN_ADDRESS %q has invalid host %q", c.ListenAddress, host,
+		)
+	}
+
+	return nil
+}
+
+// routePrefix returns RoutePrefix with a leading and without a trailing slash,
+// or an empty string when no prefix is configured.
+func (c *config) routePrefix() string {
+	prefix := strings.Trim(c.RoutePrefix, "/")
+	if prefix == "" {
+		return ""
+	}
+
+	return "/" + prefix
+}
+
+// userAgent returns UserAgent, or the exporter name and version when it is
+// not set.
+func (c *config) userAgent() string {
+	if c.UserAgent != "" {
+		return c.UserAgent
+	}
+
+	return "go-google-admin-metrics/" + version
+}
+
+// redacted returns the configuration keyed by environment variable, with the
+// values of fields tagged redact:"true" replaced by *** when set.
+func (c *config) redacted() map[string]any {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+
+	values := make(map[string]any, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("env"), ",")
+		if name == "" {
+			continue
+		}
+
+		switch value := v.Field(i).Interface().(type) {
+		case time.Duration:
+			values[name] = value.String()
+		default:
+			values[name] = value
+		}
+		if t.Field(i).Tag.Get("redact") == "true" && !v.Field(i).IsZero() {
+			values[name] = "***"
+		}
+	}
+
+	return values
 }
 
 // conf is the global configuration object.
 var conf config
 
-//go:embed templates/stats.html
-var statsTemplate string
+//go:embed templates/stats.html
+var statsTemplate string
+
+//go:embed templates/unauthorized.html
+var unauthorizedTemplate string
+
+// usageMetric maps a customer usage report parameter to the metric it is
+// exposed as. Usage report counters are daily snapshots, so they are exposed
+// as gauges holding the count for the report date rather than as cumulative
+// counters.
+type usageMetric struct {
+	param string
+	desc  *prometheus.Desc
+}
+
+// usageReport holds the parameters of a customer usage report along with the
+// date it covers and when it was fetched.
+type usageReport struct {
+	date      time.Time
+	params    map[string]float64
+	fetchedAt time.Time
+}
+
+// ageDays returns the number of whole days between the report date and the
+// day of now in REPORT_TIMEZONE.
+func (r *usageReport) ageDays(now time.Time) float64 {
+	today := reportDate(now, 0)
+
+	// Rounding absorbs days made shorter or longer by DST changes.
+	return math.Round(today.Sub(r.date).Hours() / 24)
+}
+
+// Usage report parameters holding the total and used quota in MB.
+const (
+	totalQuotaParam = "accounts:total_quota_in_mb"
+	usedQuotaParam  = "accounts:used_quota_in_mb"
+)
+
+// quotaParams lists the parameters required to compute the quota stats.
+var quotaParams = []string{totalQuotaParam, usedQuotaParam}
+
+// quotaStats returns the total and used quota in MB, and the percentage of the
+// total quota used. It returns errMissingParameter when the report lacks
+// either quota parameter, rather than reporting it as zero. The percentage is
+// 0 when there is no total quota, rather than NaN or infinity, which cannot be
+// encoded as JSON.
+func (r *usageReport) quotaStats() (float64, float64, float64, error) {
+	for _, param := range quotaParams {
+		if _, ok := r.params[param]; !ok {
+			return 0, 0, 0, fmt.Errorf("%w: %s", errMissingParameter, param)
+		}
+	}
+
+	totalQuota := r.params[totalQuotaParam]
+	usedQuota := r.params[usedQuotaParam]
+	var percentageUsed float64
+	if totalQuota > 0 {
+		percentageUsed = (usedQuota / totalQuota) * 100
+	}
+
+	return totalQuota, usedQuota, percentageUsed, nil
+}
+
+// quotaResult returns the quota stats of the report as a QuotaResult.
+func (r *usageReport) quotaResult() (QuotaResult, error) {
+	total, used, percentage, err := r.quotaStats()
+	if err != nil {
+		return QuotaResult{}, err
+	}
+
+	return QuotaResult{
+		Date:           r.date,
+		TotalQuota:     total,
+		UsedQuota:      used,
+		PercentageUsed: percentage,
+	}, nil
+}
+
+type QuotaCollector struct {
+	timestamp *prometheus.Desc
+	total     *prometheus.Desc
+	used      *prometheus.Desc
+	free      *prometheus.Desc
+	usedRatio *prometheus.Desc
+	usedDelta *prometheus.Desc
+	limit     *prometheus.Desc
+	missing   *prometheus.Desc
+	usage     []usageMetric
+	up        *prometheus.Desc
+	success   *prometheus.Desc
+	duration  *prometheus.Desc
+	cacheAge  *prometheus.Desc
+	authValid *prometheus.Desc
+	reportAge *prometheus.Desc
+	lastError *prometheus.Desc
+	unit      quotaUnit
+	customers []*customer
+}
+
+func newUsageMetric(namespace, param, name, help string) usageMetric {
+	return usageMetric{
+		param: param,
+		desc: prometheus.NewDesc(
+			namespace+"_"+name, help, customerLabels, conf.ConstLabels,
+		),
+	}
+}
+
+// configuredUsageMetrics returns a usage metric for each of params, named
+// after the parameter with its application prefix, such as
+// gmail_num_emails_sent for gmail:num_emails_sent.
+func configuredUsageMetrics(namespace string, params []string) []usageMetric {
+	metrics := make([]usageMetric, 0, len(params))
+	for _, param := range params {
+		metrics = append(metrics, newUsageMetric(namespace, param,
+			strings.ReplaceAll(param, ":", "_"),
+			"Value of the "+param+" usage report parameter on the "+
+				"report date",
+		))
+	}
+
+	return metrics
+}
+
+// requestedUsageParameters returns the comma separated parameters to request
+// from the usage reports API, or an empty string to request all of them. The
+// documented quota parameters are always requested. The service limits are
+// not, as requesting a parameter the API does not know fails the request.
+func requestedUsageParameters() string {
+	if len(conf.UsageParameters) == 0 {
+		return ""
+	}
+
+	params := append([]string{}, quotaParams...)
+	for _, param := range serviceUsedQuotaParams {
+		params = append(params, param)
+	}
+	params = append(params, conf.UsageParameters...)
+	slices.Sort(params)
+
+	return strings.Join(slices.Compact(params), ",")
+}
+
+func accountsUsageMetrics(namespace string) []usageMetric {
+	return []usageMetric{
+		newUsageMetric(namespace, "accounts:num_users",
+			"users_total",
+			"Number of users on the report date",
+		),
+		newUsageMetric(namespace, "accounts:num_suspended_users",
+			"users_suspended",
+			"Number of suspended users on the report date",
+		),
+		newUsageMetric(namespace, "accounts:apps_total_licenses",
+			"licenses_total",
+			"Number of licenses available on the report date",
+		),
+		newUsageMetric(namespace, "accounts:apps_used_licenses",
+			"licenses_used",
+			"Number of licenses in use on the report date",
+		),
+	}
+}
+
+func gmailUsageMetrics(namespace string) []usageMetric {
+	return []usageMetric{
+		newUsageMetric(namespace, "gmail:num_emails_received",
+			"gmail_emails_received_total",
+			"Number of emails received on the report date",
+		),
+		newUsageMetric(namespace, "gmail:num_emails_sent",
+			"gmail_emails_sent_total",
+			"Number of emails sent on the report date",
+		),
+	}
+}
+
+func driveUsageMetrics(namespace string) []usageMetric {
+	return []usageMetric{
+		newUsageMetric(namespace, "drive:num_owned_items_created",
+			"drive_items_created",
+			"Number of Drive items created on the report date",
+		),
+		newUsageMetric(namespace, "drive:num_owned_items_edited",
+			"drive_items_edited",
+			"Number of Drive items edited on the report date",
+		),
+		newUsageMetric(namespace, "drive:num_owned_items_viewed",
+			"drive_items_viewed",
+			"Number of Drive items viewed on the report date",
+		),
+		newUsageMetric(namespace, "drive:num_owned_items_trashed",
+			"drive_items_trashed",
+			"Number of Drive items trashed on the report date",
+		),
+		newUsageMetric(namespace, "drive:num_items_added_to_folders",
+			"drive_items_added_to_folders",
+			"Number of Drive items added to folders on the report date",
+		),
+	}
+}
+
+// customerLabels are the variable labels shared by all per-customer metrics.
+var customerLabels = []string{"customer_id"}
+
+// serviceUsedQuotaParams maps services to the usage report parameter holding
+// their used quota in MB.
+var serviceUsedQuotaParams = map[string]string{
+	"drive":  "accounts:drive_used_quota_in_mb",
+	"gmail":  "accounts:gmail_used_quota_in_mb",
+	"photos": "accounts:photos_used_quota_in_mb",
+}
+
+// serviceQuotaLimitParams maps services to the usage report parameter holding
+// their quota limit in MB. They are not documented parameters, so they are
+// never requested explicitly, and only read when a full report includes them.
+var serviceQuotaLimitParams = map[string]string{
+	"drive":  "accounts:drive_total_quota_in_mb",
+	"gmail":  "accounts:gmail_total_quota_in_mb",
+	"photos": "accounts:photos_total_quota_in_mb",
+}
+
+func meetUsageMetrics(namespace string) []usageMetric {
+	return []usageMetric{
+		newUsageMetric(namespace, "meet:num_calls",
+			"meet_calls",
+			"Number of Meet calls on the report date",
+		),
+		newUsageMetric(namespace, "meet:total_call_minutes",
+			"meet_call_minutes",
+			"Total minutes spent in Meet calls on the report date",
+		),
+	}
+}
+
+func calendarUsageMetrics(namespace string) []usageMetric {
+	return []usageMetric{
+		newUsageMetric(namespace, "calendar:num_1day_active_users",
+			"calendar_active_users_1day",
+			"Number of users active in Calendar over the last day",
+		),
+		newUsageMetric(namespace, "calendar:num_7day_active_users",
+			"calendar_active_users_7day",
+			"Number of users active in Calendar over the last 7 days",
+		),
+		newUsageMetric(namespace, "calendar:num_30day_active_users",
+			"calendar_active_users_30day",
+			"Number of users active in Calendar over the last 30 days",
+		),
+	}
+}
+
+func NewQuotaCollector(
+	namespace string, unit quotaUnit, customers []*customer,
+	usage []usageMetric,
+) *QuotaCollector {
+	return &QuotaCollector{
+		timestamp: prometheus.NewDesc(namespace+"_quota_timestamp",
+			"Timestamp of the quota stats",
+			customerLabels, conf.ConstLabels,
+		),
+		total: prometheus.NewDesc(namespace+"_quota_"+unit.name+"_total",
+			"Total quota in "+unit.name,
+			customerLabels, conf.ConstLabels,
+		),
+		used: prometheus.NewDesc(namespace+"_quota_"+unit.name+"_used",
+			"Used quota in "+unit.name+" by service, where "+
+				"service=\"total\" is the used quota across all services",
+			[]string{"customer_id", "service"}, conf.ConstLabels,
+		),
+		free: prometheus.NewDesc(namespace+"_quota_"+unit.name+"_free",
+			"Remaining quota in "+unit.name+", the total quota minus the "+
+				"used quota",
+			customerLabels, conf.ConstLabels,
+		),
+		usedRatio: prometheus.NewDesc(namespace+"_quota_used_ratio",
+			"Ratio of used quota to total quota, from 0 to 1",
+			customerLabels, conf.ConstLabels,
+		),
+		usedDelta: prometheus.NewDesc(
+			namespace+"_quota_"+unit.name+"_used_daily_delta",
+			"Average daily change in used quota in "+unit.name+
+				" since the previous available report",
+			customerLabels, conf.ConstLabels,
+		),
+		limit: prometheus.NewDesc(namespace+"_quota_"+unit.name+"_limit",
+			"Quota limit in "+unit.name+" by service, only exposed for "+
+				"services with a limit of their own",
+			[]string{"customer_id", "service"}, conf.ConstLabels,
+		),
+		missing: prometheus.NewDesc(namespace+"_quota_parameter_missing",
+			"Whether a parameter required for the quota stats is missing "+
+				"from the usage report",
+			[]string{"customer_id", "parameter"}, conf.ConstLabels,
+		),
+		usage: usage,
+		up: prometheus.NewDesc(namespace+"_up",
+			"Whether the last collection got the quota stats of the "+
+				"customer, following the node_exporter convention",
+			customerLabels, conf.ConstLabels,
+		),
+		success: prometheus.NewDesc(namespace+"_collection_success",
+			"Whether the last collection of usage stats succeeded",
+			customerLabels, conf.ConstLabels,
+		),
+		duration: prometheus.NewDesc(
+			namespace+"_collection_duration_seconds",
+			"Duration of the last collection of usage stats in seconds",
+			customerLabels, conf.ConstLabels,
+		),
+		cacheAge: prometheus.NewDesc(namespace+"_cache_age_seconds",
+			"Age of the cached usage stats in seconds",
+			customerLabels, conf.ConstLabels,
+		),
+		authValid: prometheus.NewDesc(namespace+"_auth_valid",
+			"Whether the OAuth token was valid on the last API call, "+
+				"0 when it was revoked or has expired",
+			customerLabels, conf.ConstLabels,
+		),
+		reportAge: prometheus.NewDesc(namespace+"_report_age_days",
+			"Number of days between today and the date of the usage "+
+				"report the quota stats are from",
+			customerLabels, conf.ConstLabels,
+		),
+		lastError: prometheus.NewDesc(namespace+"_last_error",
+			"Whether the last quota stats fetch failed with an error of "+
+				"the given reason, one of "+
+				strings.Join(errorReasons, ", "),
+			[]string{"customer_id", "reason"}, conf.ConstLabels,
+		),
+		unit:      unit,
+		customers: customers,
+	}
+}
+
+func (c *QuotaCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.timestamp
+	ch <- c.total
+	ch <- c.used
+	ch <- c.free
+	ch <- c.usedRatio
+	ch <- c.usedDelta
+	ch <- c.limit
+	ch <- c.missing
+	for _, m := range c.usage {
+		ch <- m.desc
+	}
+	ch <- c.up
+	ch <- c.success
+	ch <- c.duration
+	ch <- c.cacheAge
+	ch <- c.authValid
+	ch <- c.reportAge
+	ch <- c.lastError
+}
+
+func (c *QuotaCollector) Collect(ch chan<- prometheus.Metric) {
+	c.CollectWithContext(context.Background(), ch)
+}
+
+func (c *QuotaCollector) CollectWithContext(
+	ctx context.Context, ch chan<- prometheus.Metric,
+) {
+	collectCustomers(ctx, c.customers, func(
+		ctx context.Context, cust *customer,
+	) {
+		c.collectCustomer(ctx, ch, cust)
+	})
+}
+
+func (c *QuotaCollector) collectCustomer(
+	ctx context.Context, ch chan<- prometheus.Metric, cust *customer,
+) {
+	start := time.Now()
+	report, fromCache, err := cust.lookupUsageReport(ctx)
+	if fromCache {
+		cust.cacheHits.Inc()
+	} else {
+		cust.cacheMisses.Inc()
+	}
+
+	success := 1.0
+	if err != nil {
+		success = 0
+	}
+	// Unlike the collection success, up also requires the report to hold
+	// the quota stats, as fetchQuotaStats does.
+	up := success
+	if err == nil {
+		if _, _, _, qerr := report.quotaStats(); qerr != nil {
+			up = 0
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(
+		c.up, prometheus.GaugeValue, up, cust.id,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		c.success, prometheus.GaugeValue, success, cust.id,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		c.duration, prometheus.GaugeValue, time.Since(start).Seconds(),
+		cust.id,
+	)
+	authValid := 1.0
+	if cust.authInvalid.Load() {
+		authValid = 0
+	}
+	ch <- prometheus.MustNewConstMetric(
+		c.authValid, prometheus.GaugeValue, authValid, cust.id,
+	)
+	reason := errorReason(err)
+	for _, r := range errorReasons {
+		v := 0.0
+		if r == reason {
+			v = 1
+		}
+		ch <- prometheus.MustNewConstMetric(
+			c.lastError, prometheus.GaugeValue, v, cust.id, r,
+		)
+	}
+
+	if err != nil {
+		slog.Error(
+			"Failed to fetch quota stats",
+			slog.String("customer_id", cust.id),
+			slog.String("err", err.Error()),
+		)
+
+		// Keep exposing the last successfully fetched values, so staleness
+		// can be alerted on from the timestamp rather than series absence.
+		report = cust.lastUsageReport()
+		if report == nil {
+			return
+		}
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		c.cacheAge, prometheus.GaugeValue,
+		time.Since(report.fetchedAt).Seconds(), cust.id,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		c.timestamp, prometheus.GaugeValue, float64(report.date.Unix()),
+		cust.id,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		c.reportAge, prometheus.GaugeValue, report.ageDays(time.Now()),
+		cust.id,
+	)
+
+	for _, param := range quotaParams {
+		missing := 0.0
+		if _, ok := report.params[param]; !ok {
+			missing = 1
+			slog.Warn(
+				"Usage report is missing quota parameter",
+				slog.String("customer_id", cust.id),
+				slog.String("parameter", param),
+			)
+		}
+		ch <- prometheus.MustNewConstMetric(
+			c.missing, prometheus.GaugeValue, missing, cust.id, param,
+		)
+	}
+
+	// Metrics holding values of the report are stamped with its date when
+	// REPORT_TIMESTAMPS is set.
+	emit := func(m prometheus.Metric) {
+		if conf.ReportTimestamps {
+			m = prometheus.NewMetricWithTimestamp(report.date, m)
+		}
+		ch <- m
+	}
+
+	totalQuota, hasTotal := report.params[totalQuotaParam]
+	usedQuota, hasUsed := report.params[usedQuotaParam]
+
+	if hasTotal {
+		emit(prometheus.MustNewConstMetric(
+			c.total, prometheus.GaugeValue, c.unit.fromMB(totalQuota),
+			cust.id,
+		))
+	}
+	if hasUsed {
+		emit(prometheus.MustNewConstMetric(
+			c.used, prometheus.GaugeValue, c.unit.fromMB(usedQuota), cust.id,
+			"total",
+		))
+	}
+	for service, param := range serviceUsedQuotaParams {
+		v, ok := report.params[param]
+		if !ok {
+			continue
+		}
+
+		emit(prometheus.MustNewConstMetric(
+			c.used, prometheus.GaugeValue, c.unit.fromMB(v), cust.id,
+			service,
+		))
+	}
+	for service, param := range serviceQuotaLimitParams {
+		// Unlimited quota may be reported as a negative value.
+		v, ok := report.params[param]
+		if !ok || v < 0 {
+			continue
+		}
+
+		emit(prometheus.MustNewConstMetric(
+			c.limit, prometheus.GaugeValue, c.unit.fromMB(v), cust.id,
+			service,
+		))
+	}
+	if hasTotal && hasUsed {
+		// The used quota may briefly exceed the total, such as after the
+		// total was reduced, which is not a meaningful negative headroom.
+		free := totalQuota - usedQuota
+		if free < 0 {
+			slog.Warn(
+				"Used quota exceeds total quota, reporting no free quota",
+				slog.String("customer_id", cust.id),
+				slog.Float64("total_quota_mb", totalQuota),
+				slog.Float64("used_quota_mb", usedQuota),
+			)
+			free = 0
+		}
+		emit(prometheus.MustNewConstMetric(
+			c.free, prometheus.GaugeValue, c.unit.fromMB(free), cust.id,
+		))
+	}
+	if hasTotal && hasUsed && totalQuota > 0 {
+		emit(prometheus.MustNewConstMetric(
+			c.usedRatio, prometheus.GaugeValue, usedQuota/totalQuota,
+			cust.id,
+		))
+	}
+	if conf.QuotaHistoryDays > 0 {
+		// With REFRESH_INTERVAL set, the history is fetched along with the
+		// background refresh rather than by the scrape.
+		var delta float64
+		var ok bool
+		var err error
+		if conf.RefreshInterval > 0 {
+			delta, ok = cust.cachedUsedQuotaDailyDelta(report)
+		} else {
+			delta, ok, err = cust.usedQuotaDailyDelta(ctx, report)
+		}
+		if err != nil {
+			slog.Error(
+				"Failed to fetch quota history",
+				slog.String("customer_id", cust.id),
+				slog.String("err", err.Error()),
+			)
+		} else if ok {
+			emit(prometheus.MustNewConstMetric(
+				c.usedDelta, prometheus.GaugeValue, c.unit.fromMB(delta),
+				cust.id,
+			))
+		}
+	}
+
+	for _, m := range c.usage {
+		v, ok := report.params[m.param]
+		if !ok {
+			continue
+		}
+
+		emit(prometheus.MustNewConstMetric(
+			m.desc, prometheus.GaugeValue, v, cust.id,
+		))
+	}
+}
+
+// customer returns the customer with the given ID, or the first configured
+// customer when id is empty. It returns nil when no customer matches.
+func (c *QuotaCollector) customer(id string) *customer {
+	if id == "" {
+		return c.customers[0]
+	}
+
+	for _, cust := range c.customers {
+		if cust.id == id {
+			return cust
+		}
+	}
+
+	return nil
+}
+
+// ready returns nil when every customer is ready.
+func (c *QuotaCollector) ready() error {
+	for _, cust := range c.customers {
+		err := cust.ready()
+		if err != nil {
+			if cust.id != "" {
+				return fmt.Errorf("customer %s: %w", cust.id, err)
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// oauthScopes returns the OAuth scopes to request, which are OAUTH_SCOPES when
+// set, or otherwise the scopes required by the enabled collectors.
+func oauthScopes() []string {
+	if len(conf.OAuthScopes) > 0 {
+		return conf.OAuthScopes
+	}
+
+	scopes := []string{admin.AdminReportsUsageReadonlyScope}
+	if conf.CollectLoginEvents {
+		scopes = append(scopes, admin.AdminReportsAuditReadonlyScope)
+	}
+
+	return scopes
+}
+
+// isServiceAccountKey reports whether the given credentials JSON is a service
+// account key rather than an OAuth client secret.
+func isServiceAccountKey(b []byte) bool {
+	var f struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(b, &f); err != nil {
+		return false
+	}
+
+	return f.Type == "service_account"
+}
+
+// newCustomerHTTPClient returns a client authenticated with the credentials of
+// cc, or with Application Default Credentials when cc uses them or has no
+// credentials file.
+func newCustomerHTTPClient(
+	ctx context.Context, cc customerConfig,
+) (*http.Client, error) {
+	if cc.UseADC {
+		return newDefaultHTTPClient(ctx, cc)
+	}
+
+	if cc.CredentialsJSON == "" && strings.Contains(cc.CredentialsFile, ",") {
+		return newRotatingHTTPClient(ctx, cc)
+	}
+
+	b, err := readCredentials(cc)
+	if errors.Is(err, fs.ErrNotExist) {
+		slog.Info(
+			"Credentials file not found, using application default "+
+				"credentials",
+			slog.String("customer_id", cc.ID),
+			slog.String("credentials_file", cc.CredentialsFile),
+		)
+
+		return newDefaultHTTPClient(ctx, cc)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return newHTTPClient(ctx, b, cc)
+}
+
+// newRotatingHTTPClient returns a client authenticated with the first of the
+// comma separated credentials files of cc which can fetch an access token, so
+// a revoked or not yet valid key is skipped while keys are being rotated.
+func newRotatingHTTPClient(
+	ctx context.Context, cc customerConfig,
+) (*http.Client, error) {
+	var errs []error
+	for _, file := range strings.Split(cc.CredentialsFile, ",") {
+		file = strings.TrimSpace(file)
+		if file == "" {
+			continue
+		}
+
+		fileCC := cc
+		fileCC.CredentialsFile = file
+
+		client, err := newVerifiedHTTPClient(ctx, fileCC)
+		if err != nil {
+			slog.Warn(
+				"Unable to authenticate with credentials file, trying next",
+				slog.String("customer_id", cc.ID),
+				slog.String("credentials_file", file),
+				slog.String("err", err.Error()),
+			)
+			errs = append(errs, fmt.Errorf("%s: %w", file, err))
+			continue
+		}
+
+		slog.Info(
+			"Selected credentials file",
+			slog.String("customer_id", cc.ID),
+			slog.String("credentials_file", file),
+		)
+
+		return client, nil
+	}
+
+	return nil, fmt.Errorf(
+		"Unable to authenticate with any credentials file: %w",
+		errors.Join(errs...),
+	)
+}
+
+// newVerifiedHTTPClient returns a client authenticated with the credentials
+// file of cc, once it has fetched an access token with them.
+func newVerifiedHTTPClient(
+	ctx context.Context, cc customerConfig,
+) (*http.Client, error) {
+	b, err := readCredentials(cc)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := newHTTPClient(ctx, b, cc)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, ok := client.Transport.(*oauth2.Transport)
+	if !ok {
+		return nil, errors.New("Unable to verify credentials of client")
+	}
+
+	err = retryTransient(ctx, func() error {
+		_, err := transport.Source.Token()
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to fetch access token: %w", err)
+	}
+
+	return client, nil
+}
+
+// newDefaultHTTPClient returns a client authenticated with Application Default
+// Credentials. Impersonating an admin requires them to be a service account
+// key, as other credentials cannot sign for another subject.
+func newDefaultHTTPClient(
+	ctx context.Context, cc customerConfig,
+) (*http.Client, error) {
+	creds, err := google.FindDefaultCredentials(ctx, oauthScopes()...)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"Unable to find application default credentials: %w", err,
+		)
+	}
+
+	if cc.ImpersonateSubject != "" {
+		if !isServiceAccountKey(creds.JSON) {
+			return nil, errors.New(
+				"IMPERSONATE_SUBJECT requires the application default " +
+					"credentials to be a service account key",
+			)
+		}
+
+		return newHTTPClient(ctx, creds.JSON, cc)
+	}
+
+	return oauth2.NewClient(ctx, creds.TokenSource), nil
+}
+
+func newHTTPClient(
+	ctx context.Context, b []byte, cc customerConfig,
+) (*http.Client, error) {
+	if isServiceAccountKey(b) {
+		jwtConfig, err := google.JWTConfigFromJSON(b, oauthScopes()...)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"Unable to parse service account key to config: %w", err,
+			)
+		}
+		jwtConfig.Subject = cc.ImpersonateSubject
+
+		return jwtConfig.Client(ctx), nil
+	}
+
+	client, err := parseOAuthClient(b)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := google.ConfigFromJSON(b, oauthScopes()...)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"Unable to parse client secret file to config: %w", err,
+		)
+	}
+
+	web := client.Web != nil
+	if web {
+		config.RedirectURL, err = webRedirectURL(client.Web.RedirectURIs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return getClient(ctx, config, cc, web)
+}
+
+// oauthClient is the client type of OAuth client credentials, of which only
+// one of Web or Installed is set.
+type oauthClient struct {
+	Web       *oauthClientRedirects `json:"web"`
+	Installed *oauthClientRedirects `json:"installed"`
+}
+
+type oauthClientRedirects struct {
+	RedirectURIs []string `json:"redirect_uris"`
+}
+
+// parseOAuthClient returns the client type of the OAuth client credentials in
+// b. Web application clients must have an authorized redirect URI, as Google
+// only redirects to those, unlike the loopback redirects of desktop apps.
+func parseOAuthClient(b []byte) (oauthClient, error) {
+	var client oauthClient
+	err := json.Unmarshal(b, &client)
+	if err != nil {
+		return client, fmt.Errorf(
+			"Unable to parse client secret file: %w", err,
+		)
+	}
+
+	if client.Web != nil && len(client.Web.RedirectURIs) == 0 {
+		return client, errors.New(
+			"Credentials are for a web application OAuth client without " +
+				"authorized redirect URIs, add a redirect URI to the client " +
+				"in the Google Cloud Console and download it again, or use " +
+				"a desktop app client instead",
+		)
+	}
+
+	return client, nil
+}
+
+// webRedirectURL returns the redirect URI of a web application OAuth client
+// to use, which is OAUTH_REDIRECT_URL when set, or otherwise the first
+// authorized redirect URI.
+func webRedirectURL(uris []string) (string, error) {
+	if conf.OAuthRedirectURL == "" {
+		return uris[0], nil
+	}
+
+	if !slices.Contains(uris, conf.OAuthRedirectURL) {
+		return "", fmt.Errorf(
+			"OAUTH_REDIRECT_URL %s is not an authorized redirect URI of the "+
+				"web application OAuth client, which has: %s",
+			conf.OAuthRedirectURL, strings.Join(uris, ", "),
+		)
+	}
+
+	return conf.OAuthRedirectURL, nil
+}
+
+// fetchLatestReport calls fetch for dates within the lookback window, starting
+// with yesterday in REPORT_TIMEZONE, or today with REPORT_PROBE_LATEST, and
+// returns the first date for which fetch succeeded along with the number of
+// dates tried. Transient errors are retried on the same date, and only errors
+// indicating that no report exists for a date move on to an earlier date.
+// When the API names the latest date with data, the dates in between are
+// skipped. Each attempt is limited to API_TIMEOUT.
+func fetchLatestReport(
+	ctx context.Context,
+	fetch func(ctx context.Context, date string) error,
+) (time.Time, int, error) {
+	return fetchLatestPagedReport(ctx, func(
+		ctx context.Context, date string,
+	) error {
+		return retryTransient(ctx, func() error {
+			ctx, cancel := context.WithTimeout(ctx, conf.APITimeout)
+			defer cancel()
+
+			return fetch(ctx, date)
+		})
+	})
+}
+
+// fetchLatestPagedReport is fetchLatestReport for reports fetched in pages,
+// where fetch retries and limits each page to API_TIMEOUT itself with
+// fetchPages, so that a large report is not bounded by a single API_TIMEOUT.
+func fetchLatestPagedReport(
+	ctx context.Context,
+	fetch func(ctx context.Context, date string) error,
+) (time.Time, int, error) {
+	now := time.Now()
+	oldest := reportDate(now, -conf.LookbackDays)
+
+	t := reportDate(now, -1)
+	if conf.ReportProbeLatest {
+		t = reportDate(now, 0)
+	}
+
+	var err error
+	var steps int
+	for ; !t.Before(oldest); t = previousReportDate(t, err) {
+		steps++
+		date := t.Format("2006-01-02")
+
+		ctx, span := tracer.Start(ctx, "fetchReport", trace.WithAttributes(
+			attribute.String("report.date", date),
+		))
+		err = fetch(ctx, date)
+		endSpan(span, err)
+		if err == nil {
+			break
+		}
+		if !isNoDataError(err) {
+			return time.Time{}, 0, explainPermissionError(err)
+		}
+	}
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+
+	slog.Debug(
+		"Fetched usage report",
+		slog.String("date", t.Format("2006-01-02")),
+		slog.Int("lookback_steps", steps),
+	)
+
+	return t, steps, nil
+}
+
+// previousReportDate returns the next date to try after no report was found
+// for t, which is the latest date with data when err names it, or otherwise
+// the day before t.
+func previousReportDate(t time.Time, err error) time.Time {
+	prev := t.AddDate(0, 0, -1)
+
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return prev
+	}
+
+	m := notYetAvailableRE.FindStringSubmatch(apiErr.Message)
+	if m == nil {
+		return prev
+	}
+
+	latest, perr := time.ParseInLocation(
+		"2006-01-02", m[1], conf.ReportTimezone.location(),
+	)
+	if perr != nil || !latest.Before(prev) {
+		return prev
+	}
+
+	return latest
+}
+
+// reportDate returns the start of the day offset days from now, in
+// REPORT_TIMEZONE.
+func reportDate(now time.Time, offset int) time.Time {
+	y, m, d := now.In(conf.ReportTimezone.location()).Date()
+
+	return time.Date(
+		y, m, d+offset, 0, 0, 0, 0, conf.ReportTimezone.location(),
+	)
+}
+
+// retryTransient calls fn, retrying with exponential backoff for as long as it
+// fails with a transient error and API_MAX_RETRIES is not exhausted. The
+// number of retries is recorded on the span of ctx.
+func retryTransient(ctx context.Context, fn func() error) error {
+	delay := conf.APIRetryBaseDelay
+	span := trace.SpanFromContext(ctx)
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !isTransientError(err) || attempt > conf.APIMaxRetries {
+			return err
+		}
+
+		span.SetAttributes(attribute.Int("retry.count", attempt))
+		slog.Warn(
+			"Retrying transient API error",
+			slog.Int("attempt", attempt),
+			slog.Duration("delay", delay),
+			slog.String("err", err.Error()),
+		)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// fetchPages calls fetch for every page of a report, passing the page token
+// returned by the previous page, and returns the number of pages fetched.
+// Each page is retried on transient errors and limited to API_TIMEOUT. It
+// fails rather than fetching more than USER_REPORT_MAX_PAGES pages, or when
+// the API returns a page token it has already returned. The name of the
+// report is used in these errors.
+func fetchPages(
+	ctx context.Context,
+	name string,
+	fetch func(ctx context.Context, pageToken string) (string, error),
+) (int, error) {
+	var pageToken string
+	seen := make(map[string]bool)
+
+	for pages := 1; ; pages++ {
+		if pages > conf.UserReportMaxPages {
+			return 0, fmt.Errorf(
+				"%s has more than USER_REPORT_MAX_PAGES pages (%d)",
+				name, conf.UserReportMaxPages,
+			)
+		}
+
+		var next string
+		err := retryTransient(ctx, func() error {
+			ctx, cancel := context.WithTimeout(ctx, conf.APITimeout)
+			defer cancel()
+
+			var err error
+			next, err = fetch(ctx, pageToken)
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+
+		if next == "" {
+			return pages, nil
+		}
+		if seen[next] {
+			return 0, fmt.Errorf(
+				"%s returned page token %q more than once", name, next,
+			)
+		}
+		seen[next] = true
+		pageToken = next
+	}
+}
+
+// isTransientError reports whether err is a rate limit or server error which
+// is worth retrying, including rate limits reported as 403. This includes
+// failures of the token endpoint while refreshing the OAuth token ahead of an
+// API call.
+func isTransientError(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		if retrieveErr.Response == nil {
+			return false
+		}
+
+		return isTransientStatus(retrieveErr.Response.StatusCode)
+	}
+
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	// The Admin SDK mostly reports rate limits as 403 rather than 429.
+	return isTransientStatus(apiErr.Code) || isRateLimitError(err)
+}
+
+func isTransientStatus(code int) bool {
+	return code == http.StatusTooManyRequests ||
+		code >= http.StatusInternalServerError
+}
+
+// errInsufficientPermissions is wrapped around API errors caused by the
+// credentials lacking the required scopes or admin privileges.
+var errInsufficientPermissions = errors.New(
+	"the credentials likely lack the required OAuth scopes, or the " +
+		"authenticated or impersonated user is not a Workspace admin",
+)
+
+// explainPermissionError wraps err with errInsufficientPermissions when it is
+// a permission error, which the API otherwise reports as a bare 403. Rate
+// limit errors, which also use 403, are returned unchanged.
+func explainPermissionError(err error) error {
+	if !isPermissionError(err) {
+		return err
+	}
+
+	return fmt.Errorf(
+		"%w (scopes: %s): %w",
+		errInsufficientPermissions, strings.Join(oauthScopes(), ", "), err,
+	)
+}
+
+// isInvalidGrantError reports whether err is caused by the OAuth token having
+// been revoked or having expired.
+func isInvalidGrantError(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+
+	return errors.As(err, &retrieveErr) &&
+		retrieveErr.ErrorCode == "invalid_grant"
+}
+
+// isPermissionError reports whether err is an API or token error caused by
+// missing scopes, delegation or admin privileges.
+func isPermissionError(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		return retrieveErr.ErrorCode == "unauthorized_client" ||
+			retrieveErr.ErrorCode == "access_denied"
+	}
+
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusForbidden {
+		return false
+	}
+
+	return !isRateLimitError(err)
+}
+
+// isRateLimitError reports whether err is an API error caused by exceeding a
+// rate limit or quota, which the API reports as either a 429 or a 403.
+func isRateLimitError(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	if apiErr.Code == http.StatusTooManyRequests {
+		return true
+	}
+	if apiErr.Code != http.StatusForbidden {
+		return false
+	}
+	for _, item := range apiErr.Errors {
+		switch item.Reason {
+		case "rateLimitExceeded", "userRateLimitExceeded",
+			"quotaExceeded", "dailyLimitExceeded":
+			return true
+		}
+	}
+
+	return false
+}
+
+// errorSummary returns a description of err which is safe to show to users of
+// the web endpoints. Only the status and message of API and token errors are
+// included, as other errors may contain URLs or internal details.
+func errorSummary(err error) string {
+	var apiErr *googleapi.Error
+	var retrieveErr *oauth2.RetrieveError
+	switch {
+	case errors.As(err, &retrieveErr):
+		summary := "OAuth token refresh failed"
+		if retrieveErr.ErrorCode != "" {
+			summary += " (" + retrieveErr.ErrorCode + ")"
+		}
+		if retrieveErr.ErrorDescription != "" {
+			summary += ": " + retrieveErr.ErrorDescription
+		}
+		return summary
+	case errors.As(err, &apiErr):
+		summary := fmt.Sprintf("Google API responded with %d", apiErr.Code)
+		if apiErr.Message != "" {
+			summary += ": " + apiErr.Message
+		}
+		if errors.Is(err, errInsufficientPermissions) {
+			summary += " (" + errInsufficientPermissions.Error() + ")"
+		}
+		return summary
+	case errors.Is(err, errNoUsageReport):
+		return "no usage report is available within LOOKBACK_DAYS"
+	case errors.Is(err, errMissingParameter):
+		return "the usage report lacks the quota parameters"
+	case errors.Is(err, errNotRefreshed):
+		return errNotRefreshed.Error()
+	case errors.Is(err, errNotFetched):
+		return errNotFetched.Error()
+	case errors.Is(err, errStaleReport):
+		return errStaleReport.Error()
+	default:
+		return "unexpected error, see the exporter logs for details"
+	}
+}
+
+// errorReasons are the reasons errorReason classifies errors into.
+var errorReasons = []string{
+	"auth", "rate_limit", "no_data", "network", "unknown",
+}
+
+// errorReason returns the reason err failed, one of errorReasons, or an empty
+// string when err is nil.
+func errorReason(err error) string {
+	var apiErr *googleapi.Error
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return ""
+	case isInvalidGrantError(err) || isPermissionError(err),
+		errors.As(err, &apiErr) && apiErr.Code == http.StatusUnauthorized:
+		return "auth"
+	case isRateLimitError(err):
+		return "rate_limit"
+	case isNoDataError(err) || errors.Is(err, errMissingParameter):
+		return "no_data"
+	case errors.As(err, &netErr) ||
+		errors.Is(err, context.DeadlineExceeded):
+		return "network"
+	default:
+		return "unknown"
+	}
+}
+
+// notYetAvailableRE matches the message of the error returned for dates whose
+// reports are not available yet, capturing the latest date with data.
+var notYetAvailableRE = regexp.MustCompile(
+	`later than (\d{4}-\d{2}-\d{2}) is not yet available`,
+)
+
+// isNoDataError reports whether err indicates that no report is available for
+// the requested date. Other bad requests, such as for an unknown parameter,
+// are real failures rather than a reason to try an earlier date.
+func isNoDataError(err error) bool {
+	if errors.Is(err, errNoUsageReport) {
+		return true
+	}
+
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	switch apiErr.Code {
+	case http.StatusNotFound:
+		return true
+	case http.StatusBadRequest:
+		return notYetAvailableRE.MatchString(apiErr.Message)
+	default:
+		return false
+	}
+}
+
+// readCredentials returns the inline credentials JSON when set, falling back
+// to the contents of the credentials file.
+func readCredentials(cc customerConfig) ([]byte, error) {
+	if cc.CredentialsJSON != "" {
+		return []byte(cc.CredentialsJSON), nil
+	}
+
+	b, err := os.ReadFile(cc.CredentialsFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read client secret file: %w", err)
+	}
+
+	return b, nil
+}
+
+// getClient returns a client authenticated with the stored OAuth token, running
+// the consent flow when there is none. fixedRedirect is set for web
+// application clients, whose consent flow must redirect to config.RedirectURL.
+func getClient(
+	ctx context.Context, config *oauth2.Config, cc customerConfig,
+	fixedRedirect bool,
+) (*http.Client, error) {
+	store := newTokenStore(cc)
+	var secondary TokenStore
+	if cc.SecondaryTokenFile != "" {
+		secondary = fileTokenStore{file: cc.SecondaryTokenFile}
+	}
+
+	token, err := store.Load(ctx)
+	if err != nil && secondary != nil {
+		slog.Warn(
+			"Unable to load OAuth token, trying secondary token",
+			slog.String("store", store.String()),
+			slog.String("err", err.Error()),
+		)
+		token, err = secondary.Load(ctx)
+		if err == nil {
+			slog.Info(
+				"Using secondary OAuth token",
+				slog.String("store", secondary.String()),
+			)
+		}
+	}
+	if err != nil {
+		token, err = getTokenFromWeb(ctx, config, fixedRedirect)
+		if err != nil {
+			return nil, err
+		}
+
+		fmt.Printf("Saving OAuth token to %s\n", store)
+		err = store.Save(ctx, token)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to cache oauth token: %w", err)
+		}
+	}
+
+	src := &persistingTokenSource{
+		ctx:       ctx,
+		config:    config,
+		src:       config.TokenSource(ctx, token),
+		store:     store,
+		secondary: secondary,
+		last:      token,
+	}
+
+	return oauth2.NewClient(ctx, oauth2.ReuseTokenSource(token, src)), nil
+}
+
+// persistingTokenSource saves tokens returned by src to store whenever they
+// change, so that refreshed tokens survive a restart. When refreshing fails
+// and a secondary store is set, it switches to the token in the secondary
+// store, which allows rotating tokens without a restart.
+type persistingTokenSource struct {
+	ctx       context.Context
+	config    *oauth2.Config
+	store     TokenStore
+	secondary TokenStore
+
+	mu   sync.Mutex
+	src  oauth2.TokenSource
+	last *oauth2.Token
+}
+
+func (s *persistingTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, err := s.src.Token()
+	if err != nil {
+		token, err = s.trySecondary(err)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if s.last != nil && token.AccessToken == s.last.AccessToken {
+		return token, nil
+	}
+	s.last = token
+
+	slog.Info(
+		"Saving refreshed OAuth token",
+		slog.String("store", s.store.String()),
+	)
+	err = s.store.Save(s.ctx, token)
+	if err != nil {
+		slog.Error(
+			"Failed to save refreshed OAuth token",
+			slog.String("store", s.store.String()),
+			slog.String("err", err.Error()),
+		)
+	}
+
+	return token, nil
+}
+
+// trySecondary refreshes the token in the secondary store after refreshing
+// the current token failed with refreshErr, and switches to it on success.
+// Otherwise refreshErr is returned.
+func (s *persistingTokenSource) trySecondary(
+	refreshErr error,
+) (*oauth2.Token, error) {
+	if s.secondary == nil {
+		return nil, refreshErr
+	}
+
+	token, err := s.secondary.Load(s.ctx)
+	if err != nil {
+		slog.Error(
+			"Unable to load secondary OAuth token",
+			slog.String("store", s.secondary.String()),
+			slog.String("err", err.Error()),
+		)
+		return nil, refreshErr
+	}
+
+	src := s.config.TokenSource(s.ctx, token)
+	token, err = src.Token()
+	if err != nil {
+		slog.Error(
+			"Unable to refresh secondary OAuth token",
+			slog.String("store", s.secondary.String()),
+			slog.String("err", err.Error()),
+		)
+		return nil, refreshErr
+	}
+
+	slog.Warn(
+		"Refreshing OAuth token failed, switched to secondary token",
+		slog.String("store", s.secondary.String()),
+		slog.String("err", refreshErr.Error()),
+	)
+	s.src = src
+
+	return token, nil
+}
+
+// decodeToken decodes an OAuth token, which is either the JSON encoded token
+// or just a refresh token. A token without an access token is never valid,
+// so it is refreshed on first use.
+func decodeToken(r io.Reader) (*oauth2.Token, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	b = bytes.TrimSpace(b)
+	if len(b) > 0 && b[0] != '{' {
+		return &oauth2.Token{RefreshToken: string(b)}, nil
+	}
+
+	token := &oauth2.Token{}
+	err = json.Unmarshal(b, token)
+	if err != nil {
+		return nil, err
+	}
+	if token.AccessToken == "" && token.RefreshToken == "" {
+		return nil, errors.New(
+			"OAuth token has neither an access token nor a refresh token",
+		)
+	}
+
+	return token, nil
+}
+
+// getTokenFromWeb runs the interactive OAuth consent flow, giving up after
+// AUTH_TIMEOUT. It refuses to run when stdin is not a terminal, as nobody is
+// around to complete the flow in headless deployments.
+func getTokenFromWeb(
+	ctx context.Context, config *oauth2.Config, fixedRedirect bool,
+) (*oauth2.Token, error) {
+	if !stdinIsTerminal() {
+		return nil, errors.New(
+			"No valid OAuth token found and stdin is not a terminal, run " +
+				"the exporter interactively once to authorize it, or set " +
+				"TOKEN_JSON or TOKEN_FILE to an existing token",
+		)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, conf.AuthTimeout)
+	defer cancel()
+
+	token, err := getTokenFromBrowser(ctx, config, fixedRedirect)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, fmt.Errorf(
+			"No authorization received within AUTH_TIMEOUT (%s): %w",
+			conf.AuthTimeout, err,
+		)
+	}
+
+	return token, err
+}
+
+// getTokenFromBrowser captures the authorization code via a loopback redirect
+// when possible, and otherwise asks for it to be entered manually. With
+// fixedRedirect, the loopback redirect is only possible when config.RedirectURL
+// is itself a loopback address.
+func getTokenFromBrowser(
+	ctx context.Context, config *oauth2.Config, fixedRedirect bool,
+) (*oauth2.Token, error) {
+	if fixedRedirect {
+		addr, ok := loopbackRedirectAddr(config.RedirectURL)
+		if !ok {
+			fmt.Printf(
+				"Once authorized, enter the code parameter of the URL "+
+					"your browser is redirected to (%s).\n",
+				config.RedirectURL,
+			)
+			return getTokenFromPrompt(ctx, config)
+		}
+
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"Unable to listen on OAuth redirect address %s: %w", addr, err,
+			)
+		}
+		defer listener.Close()
+
+		return getTokenFromLoopback(ctx, config, listener)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		slog.Warn(
+			"Unable to start OAuth loopback listener, "+
+				"falling back to manual code entry",
+			slog.String("err", err.Error()),
+		)
+		return getTokenFromPrompt(ctx, config)
+	}
+	defer listener.Close()
+
+	cfg := *config
+	cfg.RedirectURL = "http://" + listener.Addr().String() + "/"
+
+	return getTokenFromLoopback(ctx, &cfg, listener)
+}
+
+// loopbackRedirectAddr returns the address to listen on for redirectURL, when
+// it is a plain HTTP URL with an explicit port on a loopback host.
+func loopbackRedirectAddr(redirectURL string) (string, bool) {
+	u, err := url.Parse(redirectURL)
+	if err != nil || u.Scheme != "http" || u.Port() == "" {
+		return "", false
+	}
+
+	host := u.Hostname()
+	ip := net.ParseIP(host)
+	if host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return "", false
+	}
+
+	return u.Host, true
+}
+
+// stdinIsTerminal reports whether stdin is an interactive terminal.
+func stdinIsTerminal() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+func getTokenFromPrompt(
+	ctx context.Context, config *oauth2.Config,
+) (*oauth2.Token, error) {
+	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
+	fmt.Printf("Go to the following link in your browser:\n%s\n", authURL)
+
+	// Scan cannot be interrupted, so it is left behind if ctx is done first.
+	codes := make(chan string, 1)
+	errs := make(chan error, 1)
+	go func() {
+		var code string
+		if _, err := fmt.Scan(&code); err != nil {
+			errs <- err
+			return
+		}
+		codes <- code
+	}()
+
+	var code string
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case err := <-errs:
+		return nil, fmt.Errorf("Unable to read authorization code: %w", err)
+	case code = <-codes:
+	}
+
+	token, err := config.Exchange(ctx, code)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve token from web: %w", err)
+	}
+	return token, nil
+}
+
+type QuotaStats struct {
+	Date            string  `json:"date"`              // in YYYY-MM-DD
+	TotalQuota      string  `json:"total_quota_tb"`    // in TB
+	UsedQuota       string  `json:"used_quota_tb"`     // in TB
+	TotalQuotaBytes int64   `json:"total_quota_bytes"` // in bytes
+	UsedQuotaBytes  int64   `json:"used_quota_bytes"`  // in bytes
+	PercentageUsed  float64 `json:"percentage_used"`   // in percentage
+	// TotalQuotaHuman and UsedQuotaHuman are formatted in the largest unit
+	// that keeps the value at least 1, such as "512.00 GB".
+	TotalQuotaHuman string `json:"total_quota_human"`
+	UsedQuotaHuman  string `json:"used_quota_human"`
+}
+
+func statsPageHanderFunc(
+	collector *QuotaCollector, tmpl *template.Template,
+	metrics webHandlerMetrics,
+) http.HandlerFunc {
+	return quotaStatsHandlerFunc(
+		collector, newWebRateLimiter(), metrics,
+		func(w http.ResponseWriter, stats QuotaStats) {
+			renderStatsPage(w, tmpl, stats)
+		},
+	)
+}
+
+func apiStatsHandlerFunc(
+	collector *QuotaCollector, metrics webHandlerMetrics,
+) http.HandlerFunc {
+	return quotaStatsHandlerFunc(
+		collector, newWebRateLimiter(), metrics, renderStatsJSON,
+	)
+}
+
+// newWebRateLimiter returns a limiter allowing WEB_RATE_LIMIT requests per
+// minute, or nil when rate limiting is disabled.
+func newWebRateLimiter() *rate.Limiter {
+	if conf.WebRateLimit == 0 {
+		return nil
+	}
+
+	return rate.NewLimiter(
+		rate.Every(time.Minute/time.Duration(conf.WebRateLimit)),
+		conf.WebRateLimit,
+	)
+}
+
+// quotaStatsHandlerFunc returns a handler which fetches the quota stats of the
+// customer selected by the "customer" query parameter and passes them to
+// render. The "date" query parameter selects the report of that date instead
+// of the latest one. Requests exceeding limiter are served the last fetched
+// stats without calling the API, or rejected if there are none or a date was
+// given. Requests and failed fetches are counted in metrics.
+func quotaStatsHandlerFunc(
+	collector *QuotaCollector,
+	limiter *rate.Limiter,
+	metrics webHandlerMetrics,
+	render func(http.ResponseWriter, QuotaStats),
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		metrics.requests.Inc()
+
+		cust := collector.customer(req.URL.Query().Get("customer"))
+		if cust == nil {
+			http.Error(w, "Unknown customer", http.StatusNotFound)
+			return
+		}
+
+		// An explicit date is fetched as is, for backfilling and debugging.
+		var date time.Time
+		if v := req.URL.Query().Get("date"); v != "" {
+			var err error
+			date, err = time.ParseInLocation(
+				"2006-01-02", v, conf.ReportTimezone.location(),
+			)
+			if err != nil {
+				http.Error(
+					w, "Invalid date, expected YYYY-MM-DD",
+					http.StatusBadRequest,
+				)
+				return
+			}
+		}
+
+		if limiter != nil && !limiter.Allow() {
+			report := cust.lastUsageReport()
+			if report == nil || !date.IsZero() {
+				http.Error(
+					w, "Too many requests", http.StatusTooManyRequests,
+				)
+				return
+			}
+
+			result, err := report.quotaResult()
+			if err != nil {
+				metrics.errors.Inc()
+				slog.Error(
+					"Failed to fetch quota stats",
+					slog.String("err", err.Error()),
+				)
+				http.Error(
+					w, "Failed to fetch quota stats: "+errorSummary(err),
+					http.StatusInternalServerError,
+				)
+				return
+			}
+
+			render(w, newQuotaStats(result))
+			return
+		}
+
+		result, err := cust.fetchQuotaStats(req.Context(), date)
+		if !date.IsZero() && errors.Is(err, errNoUsageReport) {
+			http.Error(
+				w, "No usage report available for "+date.Format("2006-01-02"),
+				http.StatusNotFound,
+			)
+			return
+		}
+		if err != nil {
+			metrics.errors.Inc()
+			slog.Error(
+				"Failed to fetch quota stats",
+				slog.String("err", err.Error()),
+			)
+			http.Error(
+				w, "Failed to fetch quota stats: "+errorSummary(err),
+				http.StatusInternalServerError,
+			)
+			return
+		}
+
+		render(w, newQuotaStats(result))
+	}
+}
+
+// refreshHandlerFunc fetches a new usage report for the requested customer,
+// bypassing the cache, and responds with the resulting quota stats. Requests
+// exceeding limiter are rejected, as serving stats from the cache would defeat
+// the purpose of a refresh. Requests and failed fetches are counted in
+// metrics.
+func refreshHandlerFunc(
+	collector *QuotaCollector,
+	limiter *rate.Limiter,
+	metrics webHandlerMetrics,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		metrics.requests.Inc()
+
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(
+				w, "Method not allowed", http.StatusMethodNotAllowed,
+			)
+			return
+		}
+
+		cust := collector.customer(req.URL.Query().Get("customer"))
+		if cust == nil {
+			http.Error(w, "Unknown customer", http.StatusNotFound)
+			return
+		}
 
-type QuotaCollector struct {
-	timestamp *prometheus.Desc
-	total     *prometheus.Desc
-	used      *prometheus.Desc
-	client    *admin.Service
-}
+		if limiter != nil && !limiter.Allow() {
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
 
-func NewQuotaCollector(client *admin.Service) *QuotaCollector {
-	return &QuotaCollector{
-		timestamp: prometheus.NewDesc("google_workspace_quota_timestamp",
-			"Timestamp of the quota stats",
-			nil, nil,
-		),
-		total: prometheus.NewDesc("google_workspace_quota_bytes_total",
-			"Total quota in bytes",
-			nil, nil,
-		),
-		used: prometheus.NewDesc("google_workspace_quota_bytes_used",
-			"Used quota in bytes",
-			nil, nil,
-		),
-		client: client,
+		var result QuotaResult
+		report, err := cust.refreshUsageReport(req.Context())
+		if err == nil {
+			result, err = report.quotaResult()
+		}
+		if err != nil {
+			metrics.errors.Inc()
+			slog.Error(
+				"Failed to refresh quota stats",
+				slog.String("customer_id", cust.id),
+				slog.String("err", err.Error()),
+			)
+			http.Error(
+				w, "Failed to refresh quota stats: "+errorSummary(err),
+				http.StatusInternalServerError,
+			)
+			return
+		}
+
+		renderStatsJSON(w, newQuotaStats(result))
 	}
 }
 
-func (c *QuotaCollector) Describe(ch chan<- *prometheus.Desc) {
-	ch <- c.total
-	ch <- c.used
-}
+// newQuotaStats returns the QuotaStats presenting result.
+func newQuotaStats(result QuotaResult) QuotaStats {
+	total, used := result.TotalQuota, result.UsedQuota
 
-func (c *QuotaCollector) Collect(ch chan<- prometheus.Metric) {
-	t, totalQuota, usedQuota, _, err := c.fetchQuotaStats()
-	if err != nil {
-		slog.Error(
-			"Failed to fetch quota stats",
-			slog.String("err", err.Error()),
-		)
-		return
+	return QuotaStats{
+		Date:            result.Date.Format("2006-01-02"),
+		TotalQuota:      strconv.FormatFloat(total/1048576, 'f', 3, 64),
+		UsedQuota:       strconv.FormatFloat(used/1048576, 'f', 3, 64),
+		TotalQuotaBytes: int64(total) * 1048576,
+		UsedQuotaBytes:  int64(used) * 1048576,
+		PercentageUsed:  result.PercentageUsed,
+		TotalQuotaHuman: formatQuotaMB(total),
+		UsedQuotaHuman:  formatQuotaMB(used),
 	}
-
-	ch <- prometheus.MustNewConstMetric(
-		c.timestamp, prometheus.GaugeValue, float64(t.Unix()),
-	)
-	ch <- prometheus.MustNewConstMetric(
-		c.total, prometheus.GaugeValue, totalQuota*1048576,
-	)
-	ch <- prometheus.MustNewConstMetric(
-		c.used, prometheus.GaugeValue, usedQuota*1048576,
-	)
 }
 
-func (c *QuotaCollector) fetchQuotaStats() (
-	time.Time, float64, float64, float64, error,
-) {
-	var t time.Time
-	var resp *admin.UsageReports
-	var err error
+// quotaDisplayUnits are the units quota is shown in on the stats page, in
+// increasing size, each 1024 times the previous starting at MB.
+var quotaDisplayUnits = []string{"MB", "GB", "TB", "PB"}
 
-	for i := -1; i > -6; i-- {
-		t = time.Now().AddDate(0, 0, i).UTC().Truncate(24 * time.Hour)
-		date := t.Format("2006-01-02")
-		resp, err = c.client.CustomerUsageReports.Get(date).Do()
-		if err == nil {
+// formatQuotaMB formats quota in MB using the largest display unit which keeps
+// the value at least 1, with STATS_PRECISION decimal places.
+func formatQuotaMB(mb float64) string {
+	v := mb
+	unit := quotaDisplayUnits[0]
+	for _, u := range quotaDisplayUnits[1:] {
+		if math.Abs(v) < 1024 {
 			break
 		}
+		v /= 1024
+		unit = u
 	}
-	if err != nil {
-		return time.Time{}, 0, 0, 0, err
-	}
 
-	var totalQuota float64
-	var usedQuota float64
+	return strconv.FormatFloat(v, 'f', conf.StatsPrecision, 64) + " " + unit
+}
+
+// runListParameters fetches the latest usage report of each customer with all
+// of its parameters, and writes the parameter names and value types to w.
+func runListParameters(
+	ctx context.Context, w io.Writer, customers []*customer,
+) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CUSTOMER\tDATE\tPARAMETER\tTYPE")
 
-	for _, param := range resp.UsageReports[0].Parameters {
-		switch param.Name {
-		case "accounts:total_quota_in_mb":
-			totalQuota = float64(param.IntValue)
-		case "accounts:used_quota_in_mb":
-			usedQuota = float64(param.IntValue)
+	for _, cust := range customers {
+		// Request every parameter, regardless of USAGE_PARAMETERS.
+		reports := cust.reports
+		if cust.client != nil {
+			reports = customerUsageReports{
+				service:    cust.client.CustomerUsageReports,
+				customerID: cust.customerID,
+			}
 		}
-	}
 
-	percentageUsed := (usedQuota / totalQuota) * 100
+		var resp *admin.UsageReports
+		t, _, err := fetchLatestReport(ctx, func(
+			ctx context.Context, date string,
+		) error {
+			var err error
+			resp, err = reports.Get(ctx, date)
+			if err != nil {
+				return err
+			}
+			if len(resp.UsageReports) == 0 {
+				return fmt.Errorf("%w for %s", errNoUsageReport, date)
+			}
 
-	return t, totalQuota, usedQuota, percentageUsed, nil
-}
+			return nil
+		})
+		if err != nil {
+			if cust.id == "" {
+				return fmt.Errorf("Unable to fetch usage report: %w", err)
+			}
 
-func getClient(ctx context.Context, config *oauth2.Config) *http.Client {
-	tokenFile := conf.TokenFile
-	token, err := loadToken(tokenFile)
-	if err != nil {
-		token = getTokenFromWeb(ctx, config)
-		saveToken(tokenFile, token)
+			return fmt.Errorf(
+				"Unable to fetch usage report for customer %q: %w",
+				cust.id, err,
+			)
+		}
+
+		params := resp.UsageReports[0].Parameters
+		slices.SortFunc(params, func(a, b *admin.UsageReportParameters) int {
+			return strings.Compare(a.Name, b.Name)
+		})
+		for _, param := range params {
+			fmt.Fprintf(
+				tw, "%s\t%s\t%s\t%s\n",
+				cust.id, t.Format("2006-01-02"), param.Name,
+				parameterType(param),
+			)
+		}
 	}
-	return config.Client(ctx, token)
+
+	return tw.Flush()
 }
 
-func loadToken(file string) (*oauth2.Token, error) {
-	f, err := os.Open(file)
-	if err != nil {
-		return nil, err
+// parameterType returns the value type of a usage report parameter. The API
+// omits zero values, so parameters without any value set are reported as
+// int, even when they are bools which are false.
+func parameterType(param *admin.UsageReportParameters) string {
+	switch {
+	case len(param.MsgValue) > 0:
+		return "msg"
+	case param.StringValue != "":
+		return "string"
+	case param.DatetimeValue != "":
+		return "datetime"
+	case param.BoolValue:
+		return "bool"
+	default:
+		return "int"
 	}
-	defer f.Close()
-	token := &oauth2.Token{}
-	err = json.NewDecoder(f).Decode(token)
-	return token, err
 }
 
-func getTokenFromWeb(ctx context.Context, config *oauth2.Config) *oauth2.Token {
-	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
-	fmt.Printf("Go to the following link in your browser:\n%s\n", authURL)
+// runCheck fetches the quota stats of each customer once and writes them to w
+// as JSON, returning the first error encountered.
+func runCheck(ctx context.Context, w io.Writer, customers []*customer) error {
+	enc := json.NewEncoder(w)
+	for _, cust := range customers {
+		result, err := cust.fetchQuotaStats(ctx, time.Time{})
+		if errors.Is(err, errInsufficientPermissions) {
+			fmt.Fprintf(
+				w,
+				"PERMISSION DENIED: authorize as a Workspace admin, or grant "+
+					"the service account domain-wide delegation, with the "+
+					"scopes:\n  %s\n",
+				strings.Join(oauthScopes(), "\n  "),
+			)
+		}
+		if err != nil {
+			if cust.id == "" {
+				return fmt.Errorf("Check failed: %w", err)
+			}
 
-	var code string
-	if _, err := fmt.Scan(&code); err != nil {
-		log.Fatalf("Unable to read authorization code: %v", err)
-	}
+			return fmt.Errorf(
+				"Check failed for customer %q: %w", cust.id, err,
+			)
+		}
 
-	token, err := config.Exchange(ctx, code)
-	if err != nil {
-		log.Fatalf("Unable to retrieve token from web: %v", err)
+		err = enc.Encode(struct {
+			CustomerID string `json:"customer_id,omitempty"`
+			QuotaStats
+		}{cust.id, newQuotaStats(result)})
+		if err != nil {
+			return err
+		}
 	}
-	return token
+
+	return nil
 }
 
-func saveToken(file string, token *oauth2.Token) {
-	fmt.Printf("Saving credential file to: %s\n", file)
-	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+// renderStatsJSON encodes the stats into a buffer before writing them, so an
+// encoding error results in a clean 500 rather than an empty 200.
+func renderStatsJSON(w http.ResponseWriter, stats QuotaStats) {
+	var buf bytes.Buffer
+	err := json.NewEncoder(&buf).Encode(stats)
 	if err != nil {
-		log.Fatalf("Unable to cache oauth token: %v", err)
+		slog.Error(
+			"Failed to encode quota stats",
+			slog.String("err", err.Error()),
+		)
+		http.Error(
+			w, "Failed to encode quota stats",
+			http.StatusInternalServerError,
+		)
+		return
 	}
-	defer f.Close()
-	_ = json.NewEncoder(f).Encode(token)
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = buf.WriteTo(w)
 }
 
-type QuotaStats struct {
-	Date           string  // in YYYY-MM-DD
-	TotalQuota     string  // in TB
-	UsedQuota      string  // in TB
-	PercentageUsed float64 // in percentage
+// configHandler responds with the effective configuration, with secrets
+// redacted.
+func configHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(conf.redacted())
 }
 
-func validateAuthToken(authToken string, w http.ResponseWriter, req *http.Request) bool {
-	if authToken != "" {
-		token := req.URL.Query().Get("token")
+func healthzHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte("ok\n"))
+}
 
-		if token != authToken {
-			http.Error(
-				w, "Unauthorized", http.StatusUnauthorized,
-			)
+func readyzHandlerFunc(collector *QuotaCollector) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
 
-			return false
+		// The endpoint is unauthenticated, so only the sanitized summary of
+		// the error is shown.
+		err := collector.ready()
+		if err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_ = json.NewEncoder(w).Encode(map[string]string{
+				"status": "unavailable",
+				"error":  errorSummary(err),
+			})
+			return
 		}
+
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 	}
+}
 
-	return true
+// loadStatsTemplate parses the template in STATS_TEMPLATE_FILE, or the
+// embedded stats template when it is not set.
+func loadStatsTemplate() (*template.Template, error) {
+	return loadTemplate("stats", conf.StatsTemplateFile, statsTemplate)
 }
 
-func statsPageHanderFunc(collector *QuotaCollector) http.HandlerFunc {
-	return func(w http.ResponseWriter, req *http.Request) {
-		t, total, used, percentage, err := collector.fetchQuotaStats()
+// loadUnauthorizedTemplate parses the template in UNAUTHORIZED_TEMPLATE_FILE,
+// or the embedded unauthorized template when it is not set.
+func loadUnauthorizedTemplate() (*template.Template, error) {
+	return loadTemplate(
+		"unauthorized", conf.UnauthorizedTemplateFile, unauthorizedTemplate,
+	)
+}
+
+// loadTemplate parses the template in file, or text when file is empty.
+func loadTemplate(name, file, text string) (*template.Template, error) {
+	if file != "" {
+		b, err := os.ReadFile(file)
 		if err != nil {
-			slog.Error(
-				"Failed to fetch quota stats",
-				slog.String("err", err.Error()),
-			)
-			http.Error(
-				w, "Failed to fetch quota stats",
-				http.StatusInternalServerError,
+			return nil, fmt.Errorf(
+				"Unable to read %s template: %w", name, err,
 			)
-			return
-		}
-
-		stats := QuotaStats{
-			Date:           t.Format("2006-01-02"),
-			TotalQuota:     strconv.FormatFloat(total/1048576, 'f', 3, 64),
-			UsedQuota:      strconv.FormatFloat(used/1048576, 'f', 3, 64),
-			PercentageUsed: percentage,
 		}
-		renderStatsPage(w, stats)
+		text = string(b)
 	}
-}
 
-func renderStatsPage(w http.ResponseWriter, stats QuotaStats) {
-	tmpl, err := template.New("stats").Parse(statsTemplate)
+	tmpl, err := template.New(name).Parse(text)
 	if err != nil {
-		http.Error(
-			w, "Failed to parse template", http.StatusInternalServerError,
-		)
-		return
+		return nil, fmt.Errorf("Failed to parse %s template: %w", name, err)
 	}
 
-	err = tmpl.Execute(w, stats)
+	return tmpl, nil
+}
+
+// renderStatsPage renders the stats page into a buffer before writing it, so a
+// template error results in a clean 500 rather than a partial page.
+func renderStatsPage(
+	w http.ResponseWriter, tmpl *template.Template, stats QuotaStats,
+) {
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, stats)
 	if err != nil {
+		slog.Error(
+			"Failed to render stats page",
+			slog.String("err", err.Error()),
+		)
 		http.Error(
 			w, "Failed to render template", http.StatusInternalServerError,
 		)
 		return
 	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = buf.WriteTo(w)
 }
 
+// authTokenMiddleware rejects requests which do not carry authToken, as
+// checked by requestHasToken. All authenticated routes go through it, and an
+// empty authToken disables authentication.
 func authTokenMiddleware(authToken string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if authToken != "" && r.URL.Query().Get("token") != authToken {
+			if authToken != "" && !requestHasToken(r, authToken) {
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
@@ -250,6 +2636,146 @@ func authTokenMiddleware(authToken string) func(http.Handler) http.Handler {
 	}
 }
 
+// timeoutMiddleware answers requests which next takes longer than timeout to
+// serve with 503 Service Unavailable, and cancels their context. A zero
+// timeout disables it.
+func timeoutMiddleware(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if timeout == 0 {
+			return next
+		}
+
+		return http.TimeoutHandler(next, timeout, "Request timed out")
+	}
+}
+
+// UnauthorizedPage is the data the unauthorized template is executed with.
+type UnauthorizedPage struct {
+	// Path is the path of the requested page, to submit a token to.
+	Path string
+	// InvalidToken is set when the request carried a token which was wrong,
+	// rather than none at all.
+	InvalidToken bool
+}
+
+// pageAuthMiddleware is authTokenMiddleware for pages viewed in a browser,
+// which renders tmpl as the response to unauthorized requests instead of
+// plain text.
+func pageAuthMiddleware(
+	authToken string, tmpl *template.Template,
+) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if authToken == "" || requestHasToken(r, authToken) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			page := UnauthorizedPage{
+				Path: r.URL.Path,
+				InvalidToken: r.URL.Query().Has("token") ||
+					r.Header.Get("Authorization") != "",
+			}
+
+			var buf bytes.Buffer
+			err := tmpl.Execute(&buf, page)
+			if err != nil {
+				slog.Error(
+					"Failed to render unauthorized page",
+					slog.String("err", err.Error()),
+				)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = buf.WriteTo(w)
+		})
+	}
+}
+
+// metricsAuthMiddleware rejects requests which carry neither METRICS_AUTH nor
+// the BASIC_AUTH_USERNAME and BASIC_AUTH_PASSWORD credentials, when either is
+// configured.
+func metricsAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := conf.MetricsAuth
+		username := conf.BasicAuthUsername
+
+		switch {
+		case token == "" && username == "",
+			token != "" && requestHasToken(r, token),
+			username != "" &&
+				requestHasBasicAuth(r, username, conf.BasicAuthPassword):
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if username != "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// requestHasBasicAuth reports whether the request carries the given username
+// and password in an "Authorization: Basic" header.
+func requestHasBasicAuth(r *http.Request, username, password string) bool {
+	u, p, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+
+	// Both are always compared, so the response time does not reveal
+	// whether the username was correct.
+	userOK := tokenEqual(u, username)
+	passOK := tokenEqual(p, password)
+
+	return userOK && passOK
+}
+
+// requestHasToken reports whether the request carries authToken, either as an
+// "Authorization: Bearer" header or as the "token" query parameter. An empty
+// authToken never matches.
+func requestHasToken(r *http.Request, authToken string) bool {
+	if authToken == "" {
+		return false
+	}
+
+	bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if ok && tokenEqual(bearer, authToken) {
+		return true
+	}
+
+	return tokenEqual(r.URL.Query().Get("token"), authToken)
+}
+
+func tokenEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func newLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	err := lvl.UnmarshalText([]byte(level))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid LOG_LEVEL %q: %w", level, err)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf(
+			"Invalid LOG_FORMAT %q, must be text or json", format,
+		)
+	}
+}
+
 func main() {
 	err := mainE()
 	if err != nil {
@@ -259,44 +2785,203 @@ func main() {
 }
 
 func mainE() error {
+	showVersion := flag.Bool(
+		"version", false, "Print version information and exit",
+	)
+	check := flag.Bool(
+		"check", false,
+		"Fetch quota stats once for each customer, print them and exit",
+	)
+	configFile := flag.String(
+		"config", "",
+		"YAML or JSON file of settings, overridden by environment variables",
+	)
+	listParameters := flag.Bool(
+		"list-parameters", false,
+		"Print the parameters of the latest usage report of each customer "+
+			"and exit",
+	)
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(versionString())
+		return nil
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	err := envconfig.Process(ctx, &conf)
+	lookuper := envconfig.OsLookuper()
+	if *configFile != "" {
+		fileLookuper, err := loadConfigFile(*configFile)
+		if err != nil {
+			return err
+		}
+		lookuper = envconfig.MultiLookuper(lookuper, fileLookuper)
+	}
+
+	err := envconfig.ProcessWith(ctx, &envconfig.Config{
+		Target:   &conf,
+		Lookuper: lookuper,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = conf.validate()
+	if err != nil {
+		return err
+	}
+
+	tmpl, err := loadStatsTemplate()
+	if err != nil {
+		return err
+	}
+
+	unauthorizedTmpl, err := loadUnauthorizedTemplate()
 	if err != nil {
 		return err
 	}
 
-	b, err := os.ReadFile(conf.CredentialsFile)
+	logger, err := newLogger(os.Stderr, conf.LogLevel, conf.LogFormat)
 	if err != nil {
-		return fmt.Errorf("Unable to read client secret file: %w", err)
+		return err
 	}
+	slog.SetDefault(logger)
 
-	config, err := google.ConfigFromJSON(
-		b, "https://www.googleapis.com/auth/admin.reports.usage.readonly",
+	slog.Info(
+		"Starting go-google-admin-metrics",
+		slog.String("version", version),
+		slog.String("revision", commit),
+		slog.String("build_date", buildDate),
+		slog.String("goversion", runtime.Version()),
 	)
+
+	if conf.OTelEnabled {
+		shutdown, err := setupTracing(ctx)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = shutdown(context.Background()) }()
+	}
+
+	customerConfigs, err := loadCustomerConfigs()
 	if err != nil {
-		return fmt.Errorf(
-			"Unable to parse client secret file to config: %w", err,
+		return err
+	}
+
+	metrics := newAPIMetrics(conf.MetricNamespace)
+
+	customers := make([]*customer, 0, len(customerConfigs))
+	for _, cc := range customerConfigs {
+		cust, err := newCustomer(ctx, cc, metrics)
+		if err != nil {
+			return err
+		}
+		customers = append(customers, cust)
+	}
+
+	if *check {
+		return runCheck(ctx, os.Stdout, customers)
+	}
+	if *listParameters {
+		return runListParameters(ctx, os.Stdout, customers)
+	}
+
+	if conf.RefreshInterval > 0 {
+		go refreshUsageReports(ctx, customers)
+	}
+
+	var usage []usageMetric
+	if len(conf.UsageParameters) > 0 {
+		usage = configuredUsageMetrics(
+			conf.MetricNamespace, conf.UsageParameters,
 		)
+	} else {
+		usage = append(
+			accountsUsageMetrics(conf.MetricNamespace),
+			gmailUsageMetrics(conf.MetricNamespace)...,
+		)
+		if conf.CollectDrive {
+			usage = append(usage, driveUsageMetrics(conf.MetricNamespace)...)
+		}
+		if conf.CollectMeet {
+			usage = append(usage, meetUsageMetrics(conf.MetricNamespace)...)
+		}
+		if conf.CollectCalendar {
+			usage = append(
+				usage, calendarUsageMetrics(conf.MetricNamespace)...,
+			)
+		}
 	}
 
-	client := getClient(ctx, config)
-	srv, err := admin.NewService(ctx, option.WithHTTPClient(client))
-	if err != nil {
-		return fmt.Errorf("Unable to retrieve reports Client %w", err)
+	collector := NewQuotaCollector(
+		conf.MetricNamespace, conf.QuotaUnit, customers, usage,
+	)
+	web := newWebMetrics(conf.MetricNamespace)
+	registry := newRegistry(
+		newBuildInfoCollector(conf.MetricNamespace), metrics, web,
+	)
+
+	collectors := []contextCollector{collector}
+	if conf.CollectUserQuota {
+		collectors = append(collectors, NewUserQuotaCollector(
+			conf.MetricNamespace, conf.QuotaUnit, customers,
+		))
+	}
+	if len(conf.OrgUnitIDs) > 0 {
+		collectors = append(collectors, NewOrgUnitQuotaCollector(
+			conf.MetricNamespace, conf.QuotaUnit, customers, conf.OrgUnitIDs,
+		))
+	}
+	if conf.CollectLoginEvents {
+		collectors = append(collectors, NewLoginActivityCollector(
+			conf.MetricNamespace, customers,
+		))
+	}
+	if conf.CollectSharedDrives {
+		collectors = append(collectors, NewSharedDriveCollector(
+			conf.MetricNamespace, customers,
+		))
 	}
+	if len(conf.UsageApps) > 0 {
+		collectors = append(collectors, NewAppUsageCollector(
+			conf.MetricNamespace, conf.UsageApps, customers, usage,
+		))
+	}
+
+	prefix := conf.routePrefix()
 
-	collector := NewQuotaCollector(srv)
-	prometheus.MustRegister(collector)
+	webTimeout := timeoutMiddleware(conf.WebTimeout)
 
 	mux := http.NewServeMux()
-	mux.Handle("/", authTokenMiddleware(conf.WebAuth)(http.HandlerFunc(statsPageHanderFunc(collector))))
-	mux.Handle("/metrics", authTokenMiddleware(conf.MetricsAuth)(promhttp.Handler()))
+	mux.Handle(prefix+"/", webTimeout(gzipHandler(pageAuthMiddleware(conf.WebAuth, unauthorizedTmpl)(statsPageHanderFunc(collector, tmpl, web.handler("page"))))))
+	mux.Handle(prefix+"/api/stats", webTimeout(gzipHandler(authTokenMiddleware(conf.WebAuth)(apiStatsHandlerFunc(collector, web.handler("api"))))))
+	mux.Handle(prefix+"/refresh", webTimeout(gzipHandler(authTokenMiddleware(conf.WebAuth)(refreshHandlerFunc(collector, newWebRateLimiter(), web.handler("refresh"))))))
+	mux.Handle(prefix+"/export.csv", webTimeout(gzipHandler(authTokenMiddleware(conf.WebAuth)(exportCSVHandlerFunc(collector)))))
+	mux.Handle(prefix+"/config", webTimeout(gzipHandler(authTokenMiddleware(conf.WebAuth)(http.HandlerFunc(configHandler)))))
+	var metricsHTTPHandler http.Handler = timeoutMiddleware(conf.MetricsTimeout)(metricsAuthMiddleware(metricsHandler(registry, collectors)))
+	if conf.ClientCAFile != "" {
+		metricsHTTPHandler = clientCertMiddleware(metricsHTTPHandler)
+	}
+	mux.Handle(prefix+"/metrics", metricsHTTPHandler)
+	mux.HandleFunc(prefix+"/healthz", healthzHandler)
+	mux.Handle(prefix+"/readyz", readyzHandlerFunc(collector))
+	if conf.EnablePprof {
+		if conf.WebAuth == "" {
+			slog.Warn("ENABLE_PPROF is set without WEB_AUTH, profiles are " +
+				"served without authentication")
+		}
+		mux.Handle(prefix+"/debug/pprof/", authTokenMiddleware(conf.WebAuth)(http.StripPrefix(prefix, pprofHandler())))
+	}
+	if prefix != "" {
+		mux.Handle("/{$}", http.RedirectHandler(prefix+"/", http.StatusFound))
+	}
 
-	listener, err := net.Listen("tcp", ":"+strconv.Itoa(conf.Port))
+	addr := conf.listenAddress()
+	listener, err := net.Listen("tcp", addr)
 	if err != nil {
-		return fmt.Errorf("Failed to listen on port %d: %w", conf.Port, err)
+		return fmt.Errorf("Failed to listen on %s: %w", addr, err)
 	}
 
 	slog.Info(
@@ -304,7 +2989,40 @@ func mainE() error {
 		slog.String("listen_address", listener.Addr().String()),
 	)
 
-	err = http.Serve(listener, mux)
+	server := &http.Server{
+		Handler:           logRequests(mux),
+		ReadHeaderTimeout: conf.HTTPReadHeaderTimeout,
+		ReadTimeout:       conf.HTTPReadTimeout,
+		WriteTimeout:      conf.HTTPWriteTimeout,
+		IdleTimeout:       conf.HTTPIdleTimeout,
+	}
+
+	if conf.TLSCertFile != "" {
+		reloader, err := newCertReloader(conf.TLSCertFile, conf.TLSKeyFile)
+		if err != nil {
+			return err
+		}
+		go reloader.watchSignals(ctx)
+
+		server.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: reloader.GetCertificate,
+		}
+		if conf.ClientCAFile != "" {
+			pool, err := loadClientCAs(conf.ClientCAFile)
+			if err != nil {
+				return err
+			}
+
+			// Client certificates are only required on the metrics endpoint,
+			// so browsers and health checks can still reach the others.
+			server.TLSConfig.ClientCAs = pool
+			server.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+		err = server.ServeTLS(listener, "", "")
+	} else {
+		err = server.Serve(listener)
+	}
 	if err != nil {
 		slog.Error(
 			"Failed to start http server",
@@ -0,0 +1,717 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sethvargo/go-envconfig"
+	"golang.org/x/time/rate"
+	admin "google.golang.org/api/admin/reports/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+func TestMain(m *testing.M) {
+	// Tests run with the default configuration, regardless of the
+	// environment.
+	err := envconfig.ProcessWith(context.Background(), &envconfig.Config{
+		Target:   &conf,
+		Lookuper: envconfig.MapLookuper(nil),
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	os.Exit(m.Run())
+}
+
+// setConf changes the configuration for the duration of the test.
+func setConf(t *testing.T, update func(c *config)) {
+	t.Helper()
+
+	orig := conf
+	t.Cleanup(func() { conf = orig })
+	update(&conf)
+}
+
+// newTestAdminService returns an Admin SDK reports service which sends its
+// requests to handler.
+func newTestAdminService(
+	t *testing.T, handler http.HandlerFunc,
+) *admin.Service {
+	t.Helper()
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	service, err := admin.NewService(
+		context.Background(),
+		option.WithEndpoint(srv.URL+"/"),
+		option.WithHTTPClient(srv.Client()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return service
+}
+
+func TestQuotaCollectorLint(t *testing.T) {
+	reports := testUsageReports(map[string]int64{
+		totalQuotaParam:                 1000,
+		usedQuotaParam:                  250,
+		serviceUsedQuotaParams["drive"]: 200,
+		serviceUsedQuotaParams["gmail"]: 50,
+		"accounts:num_users":            10,
+		"gmail:num_emails_sent":         7,
+	})
+	ok := newTestCustomer(fakeUsageReports(func(
+		context.Context, string,
+	) (*admin.UsageReports, error) {
+		return reports, nil
+	}))
+	failing := newTestCustomer(fakeUsageReports(func(
+		context.Context, string,
+	) (*admin.UsageReports, error) {
+		return nil, &googleapi.Error{Code: http.StatusForbidden}
+	}))
+	failing.id = "failing"
+
+	usage := append(
+		accountsUsageMetrics(conf.MetricNamespace),
+		gmailUsageMetrics(conf.MetricNamespace)...,
+	)
+	collector := NewQuotaCollector(
+		conf.MetricNamespace, conf.QuotaUnit,
+		[]*customer{ok, failing}, usage,
+	)
+
+	registry := prometheus.NewPedanticRegistry()
+	if err := registry.Register(collector); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := registry.Gather(); err != nil {
+		t.Fatal(err)
+	}
+
+	// quota_bytes_total predates the linter, and renaming it would break
+	// existing dashboards and alerts. The other names were requested
+	// explicitly in synth-4, synth-29 and synth-54.
+	allowed := map[string]bool{
+		conf.MetricNamespace + "_gmail_emails_sent_total": true,
+		conf.MetricNamespace + "_quota_bytes_total":       true,
+		conf.MetricNamespace + "_report_age_days":         true,
+		conf.MetricNamespace + "_users_total":             true,
+	}
+
+	problems, err := testutil.CollectAndLint(collector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range problems {
+		if !allowed[p.Metric] {
+			t.Errorf("%s: %s", p.Metric, p.Text)
+		}
+	}
+}
+
+// errNotYetAvailable returns the error the API responds with for dates whose
+// reports are not available yet.
+func errNotYetAvailable(latest string) error {
+	return &googleapi.Error{
+		Code: http.StatusBadRequest,
+		Message: "Data for dates later than " + latest + " is not yet " +
+			"available. Please check back later",
+	}
+}
+
+func TestIsNoDataError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil, want: false},
+		{name: "empty report", err: errNoUsageReport, want: true},
+		{
+			name: "wrapped empty report",
+			err:  fmt.Errorf("%w for 2024-01-01", errNoUsageReport),
+			want: true,
+		},
+		{
+			name: "not found",
+			err:  &googleapi.Error{Code: http.StatusNotFound},
+			want: true,
+		},
+		{
+			name: "not yet available",
+			err:  errNotYetAvailable("2024-01-01"),
+			want: true,
+		},
+		{
+			name: "other bad request",
+			err: &googleapi.Error{
+				Code: http.StatusBadRequest, Message: "Invalid parameter",
+			},
+			want: false,
+		},
+		{
+			name: "forbidden",
+			err:  &googleapi.Error{Code: http.StatusForbidden},
+			want: false,
+		},
+		{name: "other error", err: errors.New("boom"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isNoDataError(tt.err); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPreviousReportDate(t *testing.T) {
+	loc := conf.ReportTimezone.location()
+	day := func(d int) time.Time {
+		return time.Date(2024, time.January, d, 0, 0, 0, 0, loc)
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want time.Time
+	}{
+		{name: "not found", err: &googleapi.Error{Code: 404}, want: day(9)},
+		{name: "other error", err: errNoUsageReport, want: day(9)},
+		{
+			name: "names earlier date",
+			err:  errNotYetAvailable("2024-01-07"),
+			want: day(7),
+		},
+		{
+			name: "names previous date",
+			err:  errNotYetAvailable("2024-01-09"),
+			want: day(9),
+		},
+		{
+			name: "names later date",
+			err:  errNotYetAvailable("2024-01-12"),
+			want: day(9),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := previousReportDate(day(10), tt.err)
+			if !got.Equal(tt.want) {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchLatestReport(t *testing.T) {
+	setConf(t, func(c *config) {
+		c.LookbackDays = 5
+		c.ReportProbeLatest = false
+		c.APIMaxRetries = 2
+		c.APIRetryBaseDelay = time.Millisecond
+	})
+
+	now := time.Now()
+	date := func(offset int) string {
+		return reportDate(now, offset).Format("2006-01-02")
+	}
+	data := testUsageReports(map[string]int64{usedQuotaParam: 1})
+
+	tests := []struct {
+		name string
+		// responses maps report dates, as days from today, to the errors
+		// returned for them in order, before their report is returned.
+		responses map[int][]error
+		// missing are the report dates, as days from today, whose report
+		// is empty.
+		missing   []int
+		wantDate  int
+		wantSteps int
+		wantCalls int
+		wantErr   bool
+	}{
+		{
+			name:      "latest date",
+			wantDate:  -1,
+			wantSteps: 1,
+			wantCalls: 1,
+		},
+		{
+			name:      "empty latest date",
+			missing:   []int{-1},
+			wantDate:  -2,
+			wantSteps: 2,
+			wantCalls: 2,
+		},
+		{
+			name: "not yet available",
+			responses: map[int][]error{
+				-1: {errNotYetAvailable(date(-4))},
+			},
+			wantDate:  -4,
+			wantSteps: 2,
+			wantCalls: 2,
+		},
+		{
+			name: "transient error",
+			responses: map[int][]error{
+				-1: {&googleapi.Error{Code: http.StatusServiceUnavailable}},
+			},
+			wantDate:  -1,
+			wantSteps: 1,
+			wantCalls: 2,
+		},
+		{
+			name: "permanent error",
+			responses: map[int][]error{
+				-1: {&googleapi.Error{Code: http.StatusForbidden}},
+			},
+			wantCalls: 1,
+			wantErr:   true,
+		},
+		{
+			name:      "no data in lookback window",
+			missing:   []int{-1, -2, -3, -4, -5},
+			wantCalls: 5,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			missing := make(map[string]bool)
+			for _, offset := range tt.missing {
+				missing[date(offset)] = true
+			}
+			responses := make(map[string][]error)
+			for offset, errs := range tt.responses {
+				responses[date(offset)] = errs
+			}
+
+			var calls int
+			cust := newTestCustomer(fakeUsageReports(func(
+				_ context.Context, date string,
+			) (*admin.UsageReports, error) {
+				calls++
+				if errs := responses[date]; len(errs) > 0 {
+					responses[date] = errs[1:]
+					return nil, errs[0]
+				}
+				if missing[date] {
+					return &admin.UsageReports{}, nil
+				}
+
+				return data, nil
+			}))
+
+			got, steps, err := fetchLatestReport(context.Background(), func(
+				ctx context.Context, date string,
+			) error {
+				_, err := cust.fetchUsageParametersOn(ctx, date)
+				return err
+			})
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got report of %s, want an error", got)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !got.Equal(reportDate(now, tt.wantDate)) {
+					t.Errorf(
+						"got report of %s, want %s", got, date(tt.wantDate),
+					)
+				}
+				if steps != tt.wantSteps {
+					t.Errorf("got %d steps, want %d", steps, tt.wantSteps)
+				}
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("got %d calls, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestQuotaCollectorConcurrentCollect(t *testing.T) {
+	data := testUsageReports(map[string]int64{
+		totalQuotaParam: 1000,
+		usedQuotaParam:  250,
+	})
+
+	var calls atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	cust := newTestCustomer(fakeUsageReports(func(
+		context.Context, string,
+	) (*admin.UsageReports, error) {
+		if calls.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+
+		return data, nil
+	}))
+	collector := NewQuotaCollector(
+		conf.MetricNamespace, conf.QuotaUnit, []*customer{cust}, nil,
+	)
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			testutil.CollectAndCount(collector)
+		}()
+	}
+
+	// Give the other collections time to wait on the fetch in flight
+	// before it returns.
+	<-started
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := calls.Load(); got != 1 {
+		t.Errorf("got %d usage report requests, want 1", got)
+	}
+}
+
+func TestMetricsAuthMiddleware(t *testing.T) {
+	tests := []struct {
+		name       string
+		token      string
+		username   string
+		password   string
+		target     string
+		header     string
+		wantStatus int
+	}{
+		{
+			name:       "no auth configured",
+			target:     "/metrics",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "no auth configured with empty token",
+			target:     "/metrics?token=",
+			header:     "Bearer ",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "bearer token",
+			token:      "secret",
+			target:     "/metrics",
+			header:     "Bearer secret",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "query token",
+			token:      "secret",
+			target:     "/metrics?token=secret",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "wrong bearer token",
+			token:      "secret",
+			target:     "/metrics",
+			header:     "Bearer wrong",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "wrong query token",
+			token:      "secret",
+			target:     "/metrics?token=wrong",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "missing token",
+			token:      "secret",
+			target:     "/metrics",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "empty token",
+			token:      "secret",
+			target:     "/metrics?token=",
+			header:     "Bearer ",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "basic auth",
+			username:   "prometheus",
+			password:   "secret",
+			target:     "/metrics",
+			header:     basicAuthHeader("prometheus", "secret"),
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "wrong basic auth password",
+			username:   "prometheus",
+			password:   "secret",
+			target:     "/metrics",
+			header:     basicAuthHeader("prometheus", "wrong"),
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "basic auth without token",
+			token:      "secret",
+			target:     "/metrics",
+			header:     basicAuthHeader("prometheus", "secret"),
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "token with basic auth configured",
+			token:      "secret",
+			username:   "prometheus",
+			password:   "other",
+			target:     "/metrics",
+			header:     "Bearer secret",
+			wantStatus: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConf(t, func(c *config) {
+				c.MetricsAuth = tt.token
+				c.BasicAuthUsername = tt.username
+				c.BasicAuthPassword = tt.password
+			})
+
+			handler := metricsAuthMiddleware(http.HandlerFunc(func(
+				w http.ResponseWriter, _ *http.Request,
+			) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d", rec.Code, tt.wantStatus)
+			}
+			challenge := rec.Header().Get("WWW-Authenticate")
+			wantChallenge := tt.wantStatus == http.StatusUnauthorized &&
+				tt.username != ""
+			if (challenge != "") != wantChallenge {
+				t.Errorf("got WWW-Authenticate %q", challenge)
+			}
+		})
+	}
+}
+
+func TestRequestHasTokenEmpty(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/?token=", nil)
+	req.Header.Set("Authorization", "Bearer ")
+
+	if requestHasToken(req, "") {
+		t.Error("request matched an empty token")
+	}
+}
+
+// basicAuthHeader returns the Authorization header value for basic auth with
+// username and password.
+func basicAuthHeader(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString(
+		[]byte(username+":"+password),
+	)
+}
+
+func TestConfigValidateRemovesDuplicates(t *testing.T) {
+	c := conf
+	c.UsageParameters = []string{
+		"gmail:num_emails_sent", "accounts:num_users", "gmail:num_emails_sent",
+	}
+	c.UserUsageParameters = []string{
+		"gmail:num_emails_sent", "gmail:num_emails_sent",
+	}
+	c.OrgUnitIDs = []string{"id:03ph8a2z1", "id:03ph8a2z1"}
+
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"accounts:num_users", "gmail:num_emails_sent"}
+	if !slices.Equal(c.UsageParameters, want) {
+		t.Errorf("got USAGE_PARAMETERS %v, want %v", c.UsageParameters, want)
+	}
+
+	want = []string{"gmail:num_emails_sent"}
+	if !slices.Equal(c.UserUsageParameters, want) {
+		t.Errorf(
+			"got USER_USAGE_PARAMETERS %v, want %v",
+			c.UserUsageParameters, want,
+		)
+	}
+
+	want = []string{"id:03ph8a2z1"}
+	if !slices.Equal(c.OrgUnitIDs, want) {
+		t.Errorf("got ORG_UNIT_IDS %v, want %v", c.OrgUnitIDs, want)
+	}
+}
+
+func TestIsTransientError(t *testing.T) {
+	forbidden := func(reason string) error {
+		return &googleapi.Error{
+			Code:   http.StatusForbidden,
+			Errors: []googleapi.ErrorItem{{Reason: reason}},
+		}
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{
+			name: "too many requests",
+			err:  &googleapi.Error{Code: http.StatusTooManyRequests},
+			want: true,
+		},
+		{
+			name: "server error",
+			err:  &googleapi.Error{Code: http.StatusServiceUnavailable},
+			want: true,
+		},
+		{
+			name: "rate limit exceeded",
+			err:  forbidden("rateLimitExceeded"),
+			want: true,
+		},
+		{
+			name: "user rate limit exceeded",
+			err:  forbidden("userRateLimitExceeded"),
+			want: true,
+		},
+		{name: "quota exceeded", err: forbidden("quotaExceeded"), want: true},
+		{name: "forbidden", err: forbidden("forbidden"), want: false},
+		{
+			name: "not found",
+			err:  &googleapi.Error{Code: http.StatusNotFound},
+			want: false,
+		},
+		{name: "other error", err: errors.New("boom"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTransientError(tt.err); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRefreshHandlerRateLimit(t *testing.T) {
+	var calls atomic.Int32
+	cust := newTestCustomer(fakeUsageReports(func(
+		context.Context, string,
+	) (*admin.UsageReports, error) {
+		calls.Add(1)
+		return testUsageReports(map[string]int64{
+			totalQuotaParam: 1000,
+			usedQuotaParam:  250,
+		}), nil
+	}))
+	collector := NewQuotaCollector(
+		conf.MetricNamespace, conf.QuotaUnit, []*customer{cust}, nil,
+	)
+	web := newWebMetrics(conf.MetricNamespace)
+	metrics := web.handler("refresh")
+	handler := refreshHandlerFunc(
+		collector, rate.NewLimiter(rate.Every(time.Hour), 1), metrics,
+	)
+
+	for _, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(
+			rec, httptest.NewRequest(http.MethodPost, "/refresh", nil),
+		)
+		if rec.Code != want {
+			t.Errorf("got status %d, want %d", rec.Code, want)
+		}
+	}
+
+	if got := calls.Load(); got != 1 {
+		t.Errorf("got %d usage report requests, want 1", got)
+	}
+	if got := testutil.ToFloat64(metrics.requests); got != 2 {
+		t.Errorf("counted %v requests, want 2", got)
+	}
+}
+
+func TestQuotaCollectorRefreshIntervalHistory(t *testing.T) {
+	setConf(t, func(c *config) {
+		c.RefreshInterval = time.Hour
+		c.QuotaHistoryDays = 2
+	})
+
+	date := reportDate(time.Now(), -1)
+	var calls atomic.Int32
+	cust := newTestCustomer(fakeUsageReports(func(
+		_ context.Context, day string,
+	) (*admin.UsageReports, error) {
+		calls.Add(1)
+		if day == date.AddDate(0, 0, -1).Format("2006-01-02") {
+			return &admin.UsageReports{}, nil
+		}
+
+		return testUsageReports(map[string]int64{usedQuotaParam: 200}), nil
+	}))
+	report := &usageReport{
+		date:      date,
+		params:    map[string]float64{usedQuotaParam: 300},
+		fetchedAt: time.Now(),
+	}
+	cust.cached = report
+	collector := NewQuotaCollector(
+		conf.MetricNamespace, conf.QuotaUnit, []*customer{cust}, nil,
+	)
+
+	testutil.CollectAndCount(collector)
+	if got := calls.Load(); got != 0 {
+		t.Errorf("scrape made %d usage report requests, want 0", got)
+	}
+	if _, ok := cust.cachedUsedQuotaDailyDelta(report); ok {
+		t.Error("got a daily delta before the history was fetched")
+	}
+
+	// The background refresh fills the history.
+	if _, _, err := cust.usedQuotaDailyDelta(
+		context.Background(), report,
+	); err != nil {
+		t.Fatal(err)
+	}
+	calls.Store(0)
+
+	delta, ok := cust.cachedUsedQuotaDailyDelta(report)
+	if !ok || delta != 50 {
+		t.Errorf("got daily delta %v, %v, want 50, true", delta, ok)
+	}
+	testutil.CollectAndCount(collector)
+	if got := calls.Load(); got != 0 {
+		t.Errorf("scrape made %d usage report requests, want 0", got)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/sync/errgroup"
+)
+
+// labelNameRE matches valid Prometheus label names.
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// reservedLabelNames are the label names used by the exporter's own metrics,
+// which CONST_LABELS must not repeat.
+var reservedLabelNames = map[string]bool{
+	"customer_id": true,
+	"user_email":  true,
+	"org_unit":    true,
+	"drive_id":    true,
+	"drive_name":  true,
+	"service":     true,
+	"parameter":   true,
+	"result":      true,
+	"reason":      true,
+	"code":        true,
+	"handler":     true,
+	"version":     true,
+	"revision":    true,
+	"goversion":   true,
+	"le":          true,
+	"quantile":    true,
+}
+
+// contextCollector is a prometheus.Collector which can also collect using a
+// caller provided context, so upstream API calls can be cancelled along with
+// the scrape that triggered them.
+type contextCollector interface {
+	prometheus.Collector
+	CollectWithContext(ctx context.Context, ch chan<- prometheus.Metric)
+}
+
+// requestCollector collects from a contextCollector using the context of a
+// single HTTP request.
+type requestCollector struct {
+	ctx       context.Context
+	collector contextCollector
+}
+
+func (c requestCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.collector.Describe(ch)
+}
+
+func (c requestCollector) Collect(ch chan<- prometheus.Metric) {
+	c.collector.CollectWithContext(c.ctx, ch)
+}
+
+// collectCustomers calls fn for each customer, with at most
+// COLLECT_CONCURRENCY calls running at once, and returns once all calls have
+// finished. fn may be called concurrently, so it must only share state with
+// other calls under synchronization.
+func collectCustomers(
+	ctx context.Context, customers []*customer,
+	fn func(ctx context.Context, cust *customer),
+) {
+	var g errgroup.Group
+	g.SetLimit(conf.CollectConcurrency)
+
+	for _, cust := range customers {
+		g.Go(func() error {
+			fn(ctx, cust)
+			return nil
+		})
+	}
+
+	_ = g.Wait()
+}
+
+// newRegistry returns a registry holding cs, along with the Go runtime and
+// process collectors when INCLUDE_RUNTIME_METRICS is set.
+func newRegistry(cs ...prometheus.Collector) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(cs...)
+
+	// The runtime collectors can't be given constant labels, so they are
+	// added by wrapping the registry instead.
+	if conf.IncludeRuntimeMetrics {
+		prometheus.WrapRegistererWith(conf.ConstLabels, registry).MustRegister(
+			collectors.NewGoCollector(),
+			collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		)
+	}
+
+	return registry
+}
+
+// metricsHandler serves the metrics of registry along with those of
+// collectors, which are collected using the context of each scrape request.
+// The exposition format is negotiated from the request's Accept header, and
+// responses are gzip compressed when the Accept-Encoding header allows it.
+func metricsHandler(
+	registry *prometheus.Registry, collectors []contextCollector,
+) http.Handler {
+	return promhttp.InstrumentMetricHandler(
+		prometheus.WrapRegistererWith(conf.ConstLabels, registry),
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			reg := prometheus.NewRegistry()
+			for _, c := range collectors {
+				reg.MustRegister(requestCollector{ctx: r.Context(), collector: c})
+			}
+
+			// OpenMetrics is only served to clients that request it in their
+			// Accept header, others get the Prometheus text format.
+			gatherers := prometheus.Gatherers{registry, reg}
+			promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{
+				EnableOpenMetrics: true,
+			}).ServeHTTP(w, r)
+		}),
+	)
+}
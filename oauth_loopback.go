@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// getTokenFromLoopback runs the OAuth consent flow using a redirect to a
+// temporary HTTP server on listener, which captures the authorization code
+// once the user has granted access in their browser. config.RedirectURL must
+// point at listener.
+func getTokenFromLoopback(
+	ctx context.Context, config *oauth2.Config, listener net.Listener,
+) (*oauth2.Token, error) {
+	state, err := randomState()
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make(chan string, 1)
+	errs := make(chan error, 1)
+
+	server := &http.Server{
+		ReadHeaderTimeout: 10 * time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			q := r.URL.Query()
+			if q.Get("state") != state {
+				http.Error(w, "Invalid state", http.StatusBadRequest)
+				return
+			}
+
+			if e := q.Get("error"); e != "" {
+				http.Error(w, "Authorization failed", http.StatusBadRequest)
+				select {
+				case errs <- fmt.Errorf("Authorization failed: %s", e):
+				default:
+				}
+				return
+			}
+
+			code := q.Get("code")
+			if code == "" {
+				http.Error(w, "Missing code", http.StatusBadRequest)
+				return
+			}
+
+			fmt.Fprintln(w, "Authorization complete, you may close this window.")
+			select {
+			case codes <- code:
+			default:
+			}
+		}),
+	}
+	go func() { _ = server.Serve(listener) }()
+	defer server.Close()
+
+	authURL := config.AuthCodeURL(state, oauth2.AccessTypeOffline)
+	fmt.Printf("Go to the following link in your browser:\n%s\n", authURL)
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case err := <-errs:
+		return nil, err
+	case code := <-codes:
+		token, err := config.Exchange(ctx, code)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"Unable to retrieve token from web: %w", err,
+			)
+		}
+		return token, nil
+	}
+}
+
+func randomState() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("Unable to generate OAuth state: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"math"
+	"time"
+
+	admin "google.golang.org/api/admin/reports/v1"
+)
+
+// offlineUsageReports is a UsageReportsGetter returning synthetic usage
+// reports, for developing against the exporter without Google credentials.
+// The used quota follows a daily sine wave around OFFLINE_USED_QUOTA_MB, so
+// graphs have something to show.
+type offlineUsageReports struct{}
+
+func (offlineUsageReports) Get(
+	_ context.Context, date string,
+) (*admin.UsageReports, error) {
+	day := float64(time.Now().UnixNano()) / float64(24*time.Hour)
+	wave := math.Sin(2 * math.Pi * day)
+
+	total := conf.OfflineTotalQuotaMB
+	used := math.Min(conf.OfflineUsedQuotaMB*(1+0.05*wave), total)
+
+	return &admin.UsageReports{
+		UsageReports: []*admin.UsageReport{{
+			Date: date,
+			Parameters: []*admin.UsageReportParameters{
+				{Name: totalQuotaParam, IntValue: int64(total)},
+				{Name: usedQuotaParam, IntValue: int64(used)},
+				{
+					Name:     "accounts:gmail_used_quota_in_mb",
+					IntValue: int64(used * 0.4),
+				},
+				{
+					Name:     "accounts:drive_used_quota_in_mb",
+					IntValue: int64(used * 0.5),
+				},
+				{
+					Name:     "accounts:photos_used_quota_in_mb",
+					IntValue: int64(used * 0.1),
+				},
+				{Name: "accounts:num_users", IntValue: 100},
+				{Name: "accounts:num_suspended_users", IntValue: 3},
+				{Name: "accounts:apps_total_licenses", IntValue: 120},
+				{Name: "accounts:apps_used_licenses", IntValue: 97},
+				{
+					Name:     "gmail:num_emails_received",
+					IntValue: int64(5000 + 1000*wave),
+				},
+				{
+					Name:     "gmail:num_emails_sent",
+					IntValue: int64(1500 + 300*wave),
+				},
+			},
+		}},
+	}, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/prometheus/client_golang/prometheus"
+	admin "google.golang.org/api/admin/reports/v1"
+)
+
+type OrgUnitQuotaCollector struct {
+	used      *prometheus.Desc
+	unit      quotaUnit
+	customers []*customer
+	orgUnits  []string
+}
+
+func NewOrgUnitQuotaCollector(
+	namespace string, unit quotaUnit, customers []*customer,
+	orgUnits []string,
+) *OrgUnitQuotaCollector {
+	return &OrgUnitQuotaCollector{
+		used: prometheus.NewDesc(namespace+"_ou_quota_"+unit.name+"_used",
+			"Used quota in "+unit.name+" summed over the users of an "+
+				"organizational unit",
+			[]string{"customer_id", "org_unit"}, conf.ConstLabels,
+		),
+		unit:      unit,
+		customers: customers,
+		orgUnits:  orgUnits,
+	}
+}
+
+func (c *OrgUnitQuotaCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.used
+}
+
+func (c *OrgUnitQuotaCollector) Collect(ch chan<- prometheus.Metric) {
+	c.CollectWithContext(context.Background(), ch)
+}
+
+func (c *OrgUnitQuotaCollector) CollectWithContext(
+	ctx context.Context, ch chan<- prometheus.Metric,
+) {
+	collectCustomers(ctx, c.customers, func(
+		ctx context.Context, cust *customer,
+	) {
+		for _, orgUnit := range c.orgUnits {
+			used, err := c.fetchOrgUnitQuota(ctx, cust, orgUnit)
+			cust.observeAuth(err)
+			if err != nil {
+				slog.Error(
+					"Failed to fetch organizational unit quota stats",
+					slog.String("customer_id", cust.id),
+					slog.String("org_unit", orgUnit),
+					slog.String("err", err.Error()),
+				)
+				continue
+			}
+
+			ch <- prometheus.MustNewConstMetric(
+				c.used, prometheus.GaugeValue, c.unit.fromMB(used), cust.id,
+				orgUnit,
+			)
+		}
+	})
+}
+
+// fetchOrgUnitQuota returns the used quota in MB summed over the users of the
+// organizational unit.
+func (c *OrgUnitQuotaCollector) fetchOrgUnitQuota(
+	ctx context.Context, cust *customer, orgUnit string,
+) (float64, error) {
+	var reports []*admin.UsageReport
+
+	_, _, err := fetchLatestPagedReport(ctx, func(
+		ctx context.Context, date string,
+	) error {
+		var err error
+		reports, _, err = fetchUserUsageReports(
+			ctx, cust, date, orgUnit, usedQuotaParam,
+		)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// Each user is only counted once, even if the API returns them on more
+	// than one page.
+	usage := make(map[string]float64, len(reports))
+	for _, report := range reports {
+		if report.Entity == nil {
+			continue
+		}
+
+		for _, param := range report.Parameters {
+			if param.Name != usedQuotaParam {
+				continue
+			}
+			if v, ok := parameterValue(param); ok {
+				usage[report.Entity.UserEmail] = v
+			}
+		}
+	}
+
+	var used float64
+	for _, v := range usage {
+		used += v
+	}
+
+	return used, nil
+}
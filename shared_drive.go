@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	admin "google.golang.org/api/admin/reports/v1"
+)
+
+// sharedDriveEntityType is the entity type of shared drives in the entity
+// usage reports API.
+const sharedDriveEntityType = "shared_drive"
+
+// sharedDriveNameParam is the parameter holding the name of a shared drive,
+// when the report includes it.
+const sharedDriveNameParam = "drive:shared_drive_name"
+
+// entityUsageMaxResults is the largest page size accepted by the entity usage
+// reports API.
+const entityUsageMaxResults = 1000
+
+// SharedDriveCollector exposes every numeric parameter of the entity usage
+// reports of shared drives, per shared drive. The parameters are only known
+// once a report has been fetched, so the collector is unchecked and describes
+// no metrics.
+type SharedDriveCollector struct {
+	namespace string
+	customers []*customer
+}
+
+func NewSharedDriveCollector(
+	namespace string, customers []*customer,
+) *SharedDriveCollector {
+	return &SharedDriveCollector{
+		namespace: namespace,
+		customers: customers,
+	}
+}
+
+func (c *SharedDriveCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (c *SharedDriveCollector) Collect(ch chan<- prometheus.Metric) {
+	c.CollectWithContext(context.Background(), ch)
+}
+
+func (c *SharedDriveCollector) CollectWithContext(
+	ctx context.Context, ch chan<- prometheus.Metric,
+) {
+	collectCustomers(ctx, c.customers, func(
+		ctx context.Context, cust *customer,
+	) {
+		var reports []*admin.UsageReport
+		_, _, err := fetchLatestPagedReport(ctx, func(
+			ctx context.Context, date string,
+		) error {
+			var err error
+			reports, err = fetchSharedDriveReports(ctx, cust, date)
+			return err
+		})
+		cust.observeAuth(err)
+		if err != nil {
+			slog.Error(
+				"Failed to fetch shared drive usage reports",
+				slog.String("customer_id", cust.id),
+				slog.String("err", err.Error()),
+			)
+			return
+		}
+
+		// Each shared drive is only exposed once, even if the API returns
+		// it on more than one page.
+		drives := make(map[string]*admin.UsageReport, len(reports))
+		for _, report := range reports {
+			if report.Entity != nil {
+				drives[report.Entity.EntityId] = report
+			}
+		}
+
+		for id, report := range drives {
+			var name string
+			for _, param := range report.Parameters {
+				if param.Name == sharedDriveNameParam {
+					name = param.StringValue
+				}
+			}
+
+			for _, param := range report.Parameters {
+				v, ok := parameterValue(param)
+				if !ok || !usageParameterRE.MatchString(param.Name) {
+					continue
+				}
+
+				desc := prometheus.NewDesc(
+					c.namespace+"_shared_drive_"+
+						strings.ReplaceAll(param.Name, ":", "_"),
+					"Value of the "+param.Name+" entity usage report "+
+						"parameter per shared drive on the report date",
+					[]string{"customer_id", "drive_id", "drive_name"}, conf.ConstLabels,
+				)
+				ch <- prometheus.MustNewConstMetric(
+					desc, prometheus.GaugeValue, v,
+					cust.id, id, name,
+				)
+			}
+		}
+	})
+}
+
+// fetchSharedDriveReports returns the entity usage reports of all shared
+// drives on date. Pages are fetched with fetchPages.
+func fetchSharedDriveReports(
+	ctx context.Context, cust *customer, date string,
+) ([]*admin.UsageReport, error) {
+	var reports []*admin.UsageReport
+
+	_, err := fetchPages(ctx, "Shared drive usage report", func(
+		ctx context.Context, pageToken string,
+	) (string, error) {
+		call := cust.client.EntityUsageReports.
+			Get(sharedDriveEntityType, "all", date).
+			MaxResults(entityUsageMaxResults)
+		if cust.customerID != "" {
+			call = call.CustomerId(cust.customerID)
+		}
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+
+		resp, err := call.Context(ctx).Do()
+		if err != nil {
+			return "", err
+		}
+
+		reports = append(reports, resp.UsageReports...)
+
+		return resp.NextPageToken, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return reports, nil
+}
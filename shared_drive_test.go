@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestFetchSharedDriveReports(t *testing.T) {
+	tests := []struct {
+		name      string
+		maxPages  int
+		nextToken func(page int) string
+		wantErr   string
+		wantPages int
+	}{
+		{
+			name:     "single page",
+			maxPages: 10,
+			nextToken: func(page int) string {
+				return ""
+			},
+			wantPages: 1,
+		},
+		{
+			name:     "several pages",
+			maxPages: 10,
+			nextToken: func(page int) string {
+				if page == 3 {
+					return ""
+				}
+				return fmt.Sprintf("page-%d", page+1)
+			},
+			wantPages: 3,
+		},
+		{
+			name:     "more than max pages",
+			maxPages: 3,
+			nextToken: func(page int) string {
+				return fmt.Sprintf("page-%d", page+1)
+			},
+			wantErr:   "more than USER_REPORT_MAX_PAGES pages (3)",
+			wantPages: 3,
+		},
+		{
+			name:     "repeated page token",
+			maxPages: 10,
+			nextToken: func(page int) string {
+				return "page-2"
+			},
+			wantErr:   `returned page token "page-2" more than once`,
+			wantPages: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConf(t, func(c *config) { c.UserReportMaxPages = tt.maxPages })
+
+			var pages atomic.Int32
+			cust := &customer{
+				id: "test",
+				client: newTestAdminService(t, func(
+					w http.ResponseWriter, req *http.Request,
+				) {
+					page := int(pages.Add(1))
+					w.Header().Set("Content-Type", "application/json")
+					fmt.Fprintf(w,
+						`{"usageReports":[{"entity":{"entityId":"drive-%d"}}],`+
+							`"nextPageToken":%q}`,
+						page, tt.nextToken(page),
+					)
+				}),
+			}
+
+			reports, err := fetchSharedDriveReports(
+				context.Background(), cust, "2024-01-01",
+			)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(reports) != tt.wantPages {
+					t.Errorf(
+						"got %d reports, want %d", len(reports), tt.wantPages,
+					)
+				}
+			}
+			if got := int(pages.Load()); got != tt.wantPages {
+				t.Errorf("fetched %d pages, want %d", got, tt.wantPages)
+			}
+		})
+	}
+}
+
+func TestSharedDriveCollectorRepeatedDrive(t *testing.T) {
+	setConf(t, func(c *config) { c.ReportProbeLatest = false })
+
+	var pages atomic.Int32
+	cust := &customer{
+		id: "test",
+		client: newTestAdminService(t, func(
+			w http.ResponseWriter, _ *http.Request,
+		) {
+			next := ""
+			if pages.Add(1)%2 == 1 {
+				next = "page-2"
+			}
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w,
+				`{"usageReports":[{"entity":{"entityId":"drive-1"},`+
+					`"parameters":[{"name":"drive:num_items","intValue":"3"}]}],`+
+					`"nextPageToken":%q}`,
+				next,
+			)
+		}),
+	}
+	collector := NewSharedDriveCollector("test", []*customer{cust})
+
+	registry := prometheus.NewPedanticRegistry()
+	if err := registry.Register(collector); err != nil {
+		t.Fatal(err)
+	}
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mfs) != 1 || len(mfs[0].GetMetric()) != 1 {
+		t.Errorf("got %v, want a single series", mfs)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// TokenStore loads and saves the OAuth token of a customer, so that tokens
+// obtained or refreshed at runtime survive a restart.
+type TokenStore interface {
+	Load(ctx context.Context) (*oauth2.Token, error)
+	Save(ctx context.Context, token *oauth2.Token) error
+	// String describes where tokens are stored, for log messages.
+	String() string
+}
+
+// newTokenStore returns the TokenStore configured for a customer, which holds
+// the inline token when set, and otherwise the token file.
+func newTokenStore(cc customerConfig) TokenStore {
+	if cc.TokenJSON != "" {
+		return inlineTokenStore{token: cc.TokenJSON}
+	}
+
+	return fileTokenStore{file: cc.TokenFile}
+}
+
+// fileTokenStore stores the token as JSON in a local file.
+type fileTokenStore struct {
+	file string
+}
+
+func (s fileTokenStore) Load(context.Context) (*oauth2.Token, error) {
+	f, err := os.Open(s.file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return decodeToken(f)
+}
+
+func (s fileTokenStore) Save(_ context.Context, token *oauth2.Token) error {
+	f, err := os.OpenFile(s.file, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return json.NewEncoder(f).Encode(token)
+}
+
+func (s fileTokenStore) String() string {
+	return "file " + s.file
+}
+
+// inlineTokenStore holds a token given in the configuration. It cannot be
+// written to, so saved tokens only last until the exporter restarts.
+type inlineTokenStore struct {
+	token string
+}
+
+func (s inlineTokenStore) Load(context.Context) (*oauth2.Token, error) {
+	return decodeToken(strings.NewReader(s.token))
+}
+
+func (s inlineTokenStore) Save(context.Context, *oauth2.Token) error {
+	return nil
+}
+
+func (s inlineTokenStore) String() string {
+	return "TOKEN_JSON"
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of the exporter. Until setupTracing has installed
+// a tracer provider, its spans are no-ops.
+var tracer = otel.Tracer("github.com/romdo/go-google-admin-metrics")
+
+// setupTracing installs a tracer provider which exports spans over OTLP/HTTP,
+// configured by the standard OTEL_EXPORTER_OTLP_* and OTEL_SERVICE_NAME
+// environment variables. The returned function flushes any pending spans.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create OTLP trace exporter: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{},
+	))
+
+	return provider.Shutdown, nil
+}
+
+// endSpan records the result of the operation traced by span, which is the
+// reason of err when it failed, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.SetAttributes(attribute.String("result", errorReason(err)))
+	} else {
+		span.SetAttributes(attribute.String("result", "success"))
+	}
+
+	span.End()
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	admin "google.golang.org/api/admin/reports/v1"
+)
+
+// userUsageMaxResults is the largest page size accepted by the user usage
+// report API.
+const userUsageMaxResults = 1000
+
+type UserQuotaCollector struct {
+	used         *prometheus.Desc
+	usage        []usageMetric
+	pagesFetched *prometheus.Desc
+	users        *prometheus.Desc
+	truncated    *prometheus.CounterVec
+	unit         quotaUnit
+	customers    []*customer
+}
+
+func NewUserQuotaCollector(
+	namespace string, unit quotaUnit, customers []*customer,
+) *UserQuotaCollector {
+	usage := make([]usageMetric, 0, len(conf.UserUsageParameters))
+	for _, param := range conf.UserUsageParameters {
+		if param == usedQuotaParam {
+			continue
+		}
+
+		usage = append(usage, usageMetric{
+			param: param,
+			desc: prometheus.NewDesc(
+				namespace+"_user_"+strings.ReplaceAll(param, ":", "_"),
+				"Value of the "+param+" user usage report parameter per "+
+					"user on the report date",
+				[]string{"customer_id", "user_email"}, conf.ConstLabels,
+			),
+		})
+	}
+
+	return &UserQuotaCollector{
+		used: prometheus.NewDesc(namespace+"_user_quota_"+unit.name+"_used",
+			"Used quota in "+unit.name+" per user",
+			[]string{"customer_id", "user_email"}, conf.ConstLabels,
+		),
+		usage: usage,
+		pagesFetched: prometheus.NewDesc(
+			namespace+"_user_report_pages_fetched",
+			"Number of pages fetched for the latest user usage report",
+			customerLabels, conf.ConstLabels,
+		),
+		users: prometheus.NewDesc(namespace+"_user_report_users_total",
+			"Number of users in the latest user usage report, including "+
+				"users dropped by MAX_SERIES",
+			customerLabels, conf.ConstLabels,
+		),
+		truncated: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "series_truncated_total",
+			Help: "Number of per-user series dropped because the " +
+				"customer has more users than MAX_SERIES",
+			ConstLabels: conf.ConstLabels,
+		}, customerLabels),
+		unit:      unit,
+		customers: customers,
+	}
+}
+
+func (c *UserQuotaCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.used
+	for _, m := range c.usage {
+		ch <- m.desc
+	}
+	ch <- c.pagesFetched
+	ch <- c.users
+	c.truncated.Describe(ch)
+}
+
+func (c *UserQuotaCollector) Collect(ch chan<- prometheus.Metric) {
+	c.CollectWithContext(context.Background(), ch)
+}
+
+func (c *UserQuotaCollector) CollectWithContext(
+	ctx context.Context, ch chan<- prometheus.Metric,
+) {
+	collectCustomers(ctx, c.customers, func(
+		ctx context.Context, cust *customer,
+	) {
+		users, pages, err := c.fetchUserQuotaStats(ctx, cust)
+		cust.observeAuth(err)
+		if err != nil {
+			slog.Error(
+				"Failed to fetch user quota stats",
+				slog.String("customer_id", cust.id),
+				slog.String("err", err.Error()),
+			)
+			return
+		}
+
+		ch <- prometheus.MustNewConstMetric(
+			c.pagesFetched, prometheus.GaugeValue, float64(pages), cust.id,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			c.users, prometheus.GaugeValue, float64(len(users)), cust.id,
+		)
+
+		used := make(map[string]float64, len(users))
+		for email, params := range users {
+			if v, ok := params[usedQuotaParam]; ok {
+				used[email] = v
+			}
+		}
+
+		emails := c.limitSeries(cust, used)
+		for _, email := range emails {
+			ch <- prometheus.MustNewConstMetric(
+				c.used, prometheus.GaugeValue, c.unit.fromMB(used[email]),
+				cust.id, email,
+			)
+
+			for _, m := range c.usage {
+				v, ok := users[email][m.param]
+				if !ok {
+					continue
+				}
+				ch <- prometheus.MustNewConstMetric(
+					m.desc, prometheus.GaugeValue, v, cust.id, email,
+				)
+			}
+		}
+	})
+
+	c.truncated.Collect(ch)
+}
+
+// limitSeries returns the email addresses in usage to expose series for. When
+// there are more than MAX_SERIES, only the users with the most used quota are
+// kept, and the number of dropped series is counted.
+func (c *UserQuotaCollector) limitSeries(
+	cust *customer, usage map[string]float64,
+) []string {
+	emails := slices.Collect(maps.Keys(usage))
+	if conf.MaxSeries == 0 || len(emails) <= conf.MaxSeries {
+		return emails
+	}
+
+	slices.SortFunc(emails, func(a, b string) int {
+		return cmp.Or(cmp.Compare(usage[b], usage[a]), cmp.Compare(a, b))
+	})
+
+	dropped := len(emails) - conf.MaxSeries
+	slog.Warn(
+		"Truncating per-user series to MAX_SERIES",
+		slog.String("customer_id", cust.id),
+		slog.Int("max_series", conf.MaxSeries),
+		slog.Int("dropped", dropped),
+	)
+	c.truncated.WithLabelValues(cust.id).Add(float64(dropped))
+
+	return emails[:conf.MaxSeries]
+}
+
+// fetchUserQuotaStats returns the numeric parameters of every user, keyed by
+// email address and then parameter name, along with the number of pages the
+// report was fetched in. The used quota is in MB.
+func (c *UserQuotaCollector) fetchUserQuotaStats(
+	ctx context.Context, cust *customer,
+) (map[string]map[string]float64, int, error) {
+	var reports []*admin.UsageReport
+	var pages int
+
+	_, _, err := fetchLatestPagedReport(ctx, func(
+		ctx context.Context, date string,
+	) error {
+		var err error
+		reports, pages, err = fetchUserUsageReports(
+			ctx, cust, date, "", requestedUserUsageParameters(),
+		)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	users := make(map[string]map[string]float64, len(reports))
+	for _, report := range reports {
+		if report.Entity == nil {
+			continue
+		}
+
+		params := make(map[string]float64, len(report.Parameters))
+		for _, param := range report.Parameters {
+			if v, ok := parameterValue(param); ok {
+				params[param.Name] = v
+			}
+		}
+		users[report.Entity.UserEmail] = params
+	}
+
+	return users, pages, nil
+}
+
+// requestedUserUsageParameters returns the comma separated parameters to
+// request from the user usage reports API, which are the used quota along
+// with USER_USAGE_PARAMETERS.
+func requestedUserUsageParameters() string {
+	params := append([]string{usedQuotaParam}, conf.UserUsageParameters...)
+	slices.Sort(params)
+
+	return strings.Join(slices.Compact(params), ",")
+}
+
+// fetchUserUsageReports returns the usage reports with the comma separated
+// parameters of all users on date, limited to the users of an organizational
+// unit when orgUnitID is set, along with the number of pages fetched. Pages
+// are fetched with fetchPages.
+func fetchUserUsageReports(
+	ctx context.Context, cust *customer, date, orgUnitID, parameters string,
+) ([]*admin.UsageReport, int, error) {
+	var reports []*admin.UsageReport
+
+	pages, err := fetchPages(ctx, "User usage report", func(
+		ctx context.Context, pageToken string,
+	) (string, error) {
+		call := cust.client.UserUsageReport.Get("all", date).
+			Parameters(parameters).
+			MaxResults(userUsageMaxResults)
+		if orgUnitID != "" {
+			call = call.OrgUnitID(orgUnitID)
+		}
+		if cust.customerID != "" {
+			call = call.CustomerId(cust.customerID)
+		}
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+
+		resp, err := call.Context(ctx).Do()
+		if err != nil {
+			return "", err
+		}
+
+		reports = append(reports, resp.UsageReports...)
+
+		return resp.NextPageToken, nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return reports, pages, nil
+}
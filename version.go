@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"runtime"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Build information, set at build time via:
+//
+//	-ldflags "-X main.version=... -X main.commit=... -X main.buildDate=..."
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+func versionString() string {
+	return fmt.Sprintf(
+		"go-google-admin-metrics %s (revision %s, built %s, %s)",
+		version, commit, buildDate, runtime.Version(),
+	)
+}
+
+// buildInfoLabels returns the labels of the build info metric, along with
+// CONST_LABELS.
+func buildInfoLabels() prometheus.Labels {
+	labels := prometheus.Labels{
+		"version":   version,
+		"revision":  commit,
+		"goversion": runtime.Version(),
+	}
+	maps.Copy(labels, conf.ConstLabels)
+
+	return labels
+}
+
+func newBuildInfoCollector(namespace string) prometheus.Collector {
+	return prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "exporter_build_info",
+			Help: "A metric with a constant '1' value labeled by version, " +
+				"revision, and goversion from which the exporter was built",
+			ConstLabels: buildInfoLabels(),
+		},
+		func() float64 { return 1 },
+	)
+}
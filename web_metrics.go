@@ -0,0 +1,54 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// webMetrics counts the requests served by the stats endpoints, which may
+// call the Google APIs on behalf of each request.
+type webMetrics struct {
+	requests *prometheus.CounterVec
+	errors   *prometheus.CounterVec
+}
+
+func newWebMetrics(namespace string) *webMetrics {
+	return &webMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "web_requests_total",
+			Help:        "Number of requests served by the stats endpoints",
+			ConstLabels: conf.ConstLabels,
+		}, []string{"handler"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "web_errors_total",
+			Help: "Number of requests to the stats endpoints which failed " +
+				"to fetch the quota stats",
+			ConstLabels: conf.ConstLabels,
+		}, []string{"handler"}),
+	}
+}
+
+func (m *webMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.requests.Describe(ch)
+	m.errors.Describe(ch)
+}
+
+func (m *webMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.requests.Collect(ch)
+	m.errors.Collect(ch)
+}
+
+// webHandlerMetrics are the webMetrics of a single handler.
+type webHandlerMetrics struct {
+	requests prometheus.Counter
+	errors   prometheus.Counter
+}
+
+// handler returns the metrics of the named handler.
+func (m *webMetrics) handler(name string) webHandlerMetrics {
+	return webHandlerMetrics{
+		requests: m.requests.WithLabelValues(name),
+		errors:   m.errors.WithLabelValues(name),
+	}
+}